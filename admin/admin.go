@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/etcd"
+	"simple_proxygateway/logger"
+	"simple_proxygateway/transmit/middleware"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Prefix 管理接口路由前缀
+const Prefix = "/go/admin/"
+
+type (
+	adminHandler struct {
+		serviceDiscover etcd.ServiceDiscover
+		gauger          middleware.Gauger
+		token           string
+		mux             *http.ServeMux
+	}
+	response struct {
+		Msg  string
+		Data interface{}
+		Code int
+	}
+)
+
+// TokenRequiredErr 管理接口与转发共用监听，未配置token时不允许开启
+var TokenRequiredErr = errors.New("admin token required")
+
+// NewAdminHandler gauger 为网关实例的指标来源
+func NewAdminHandler(serviceDiscover etcd.ServiceDiscover, gauger middleware.Gauger, adminConfig config.Admin) (http.Handler, error) {
+	if adminConfig.Token == "" {
+		return nil, TokenRequiredErr
+	}
+	handler := &adminHandler{
+		serviceDiscover: serviceDiscover,
+		gauger:          gauger,
+		token:           adminConfig.Token,
+		mux:             http.NewServeMux(),
+	}
+	handler.mux.HandleFunc(Prefix+"split", handler.split)
+	handler.mux.HandleFunc(Prefix+"drain", handler.drain)
+	handler.mux.HandleFunc(Prefix+"metrics", handler.metrics)
+	return handler, nil
+}
+
+func (handler *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Admin-Token")), []byte(handler.token)) != 1 {
+		writeJson(w, http.StatusForbidden, "error!invalid admin token", "")
+		return
+	}
+	handler.mux.ServeHTTP(w, r)
+}
+
+// split GET 查询路由流量切分，PUT 更新路由流量切分
+func (handler *adminHandler) split(w http.ResponseWriter, r *http.Request) {
+	routeName := r.URL.Query().Get("route")
+	if routeName == "" {
+		writeJson(w, http.StatusBadRequest, "error!route is required", "")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, "success", handler.serviceDiscover.GetSplit(routeName))
+	case http.MethodPut, http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeJson(w, http.StatusBadRequest, "error!read body failed", "")
+			return
+		}
+		splitSlice := make([]config.SplitStruct, 0)
+		if err = jsoniter.Unmarshal(body, &splitSlice); err != nil {
+			writeJson(w, http.StatusBadRequest, "error!invalid split data", "")
+			return
+		}
+		totalWeight := 0
+		for _, split := range splitSlice {
+			if split.ServiceName == "" || split.Weight < 0 {
+				writeJson(w, http.StatusBadRequest, "error!invalid split data", "")
+				return
+			}
+			totalWeight += split.Weight
+		}
+		if totalWeight == 0 {
+			writeJson(w, http.StatusBadRequest, "error!total weight must be greater than 0", "")
+			return
+		}
+		if err = handler.serviceDiscover.PutSplit(routeName, splitSlice); err != nil {
+			logger.Runtime.Error("put split err:" + err.Error())
+			writeJson(w, http.StatusInternalServerError, "error!put split failed", "")
+			return
+		}
+		writeJson(w, http.StatusOK, "success", splitSlice)
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, "error!method not allowed", "")
+	}
+}
+
+// drain PUT 标记节点下线，draining=false 时取消标记
+func (handler *adminHandler) drain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, "error!method not allowed", "")
+		return
+	}
+	query := r.URL.Query()
+	serviceName, url := query.Get("service"), query.Get("url")
+	if serviceName == "" || url == "" {
+		writeJson(w, http.StatusBadRequest, "error!service and url are required", "")
+		return
+	}
+	draining := query.Get("draining") != "false"
+	err := handler.serviceDiscover.SetDraining(serviceName, url, draining)
+	switch err {
+	case nil:
+		writeJson(w, http.StatusOK, "success", "")
+	case etcd.ServiceNotFoundErr, etcd.EndpointNotFoundErr:
+		writeJson(w, http.StatusNotFound, "error!"+err.Error(), "")
+	case etcd.ConflictErr:
+		writeJson(w, http.StatusConflict, "error!"+err.Error(), "")
+	default:
+		logger.Runtime.Error("set draining err:" + err.Error())
+		writeJson(w, http.StatusInternalServerError, "error!set draining failed", "")
+	}
+}
+
+// metrics GET 查询当前网关实例的中间件指标，如 restrictor 各排队等级的排队数
+func (handler *adminHandler) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJson(w, http.StatusMethodNotAllowed, "error!method not allowed", "")
+		return
+	}
+	writeJson(w, http.StatusOK, "success", handler.gauger.Gauges())
+}
+
+func writeJson(w http.ResponseWriter, code int, msg string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	respJson, _ := jsoniter.Marshal(response{Msg: msg, Data: data, Code: code})
+	_, _ = w.Write(respJson)
+}
@@ -2,20 +2,33 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	"simple_proxygateway/config"
 	"simple_proxygateway/logger"
+
+	"golang.org/x/sync/semaphore"
 )
 
 type (
-	builder interface {
-		new(client config.Collector) writer
+	// Sink 采集输出，网关按批次调用 WriteBatch，WriteBatch 可能被并发调用；
+	// 停止时依次写入剩余事件、调用 Flush 及 Close
+	Sink interface {
+		// Init 初始化输出，params 为配置 collector.sinks 中对应名称的参数
+		Init(collectorConfig config.Collector, params map[string]interface{}) error
+		WriteBatch(ctx context.Context, eventSlice []Event) error
+		Flush(ctx context.Context) error
+		Close() error
 	}
-	writer interface {
-		run(ctx context.Context, dataChan <-chan interface{})
+	// SinkFactory 每次启动采集时创建新的 Sink
+	SinkFactory func() Sink
+	// Event 采集事件，Type 区分事件类型，Data 为事件内容
+	Event struct {
+		Type string
+		Time time.Time
+		Data interface{}
 	}
 	EsMsg struct {
 		ServiceName      string
@@ -25,51 +38,199 @@ type (
 		Host             string
 		StatusCode       int
 	}
+	RolloutMsg struct {
+		Route             string
+		BaselineService   string
+		CanaryService     string
+		Step              int
+		Action            string
+		BaselineErrorRate float64
+		CanaryErrorRate   float64
+		BaselineLatency   float64
+		CanaryLatency     float64
+		RecordTime        int
+	}
+	// MetricMsg 网关实例定时采集的指标，Gateway 区分同一进程或集群中的网关实例
+	MetricMsg struct {
+		Gateway    string
+		Name       string
+		Value      int64
+		RecordTime int
+	}
+)
+
+const (
+	TransmitEvent = "transmit"
+	RolloutEvent  = "rollout"
+	MetricEvent   = "metric"
 )
 
+// Collector 采集实例，由网关实例持有，为nil时丢弃全部事件
+type Collector struct {
+	dataChan  chan Event
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeChan chan struct{}
+}
+
 var (
-	dataChan                          = make(chan interface{}, 200)
-	builderMap                        = make(map[string]builder)
-	collectorCtx, collectorCancelFunc = context.WithCancel(context.Background())
-	closeChan                         = make(chan struct{}, 1)
-	running                           bool
+	sinkMap                    = make(map[string]SinkFactory)
+	dataChanSize               = 200
+	defaultBatchSize           = 20
+	defaultFlushInterval       = 5
+	goroutineLimit       int64 = 100
+	goroutineWeight      int64 = 1
+	writeTimeout               = 5 * time.Second
+	SinkNotSetErr              = errors.New("collector switch do not set")
+	SinkNotExistsErr           = errors.New("collector not exists")
 )
 
-func NewCollector(config config.Client) {
-	if config.Collector.Switch == "" {
-		log.Fatal("switch do not set")
-	}
-	if builderHandler, ok := builderMap[config.Collector.Switch]; ok {
-		handler := builderHandler.new(config.Collector)
-		go func() {
-			running = true
-			handler.run(collectorCtx, dataChan)
-			closeChan <- struct{}{}
-		}()
+// RegisterSink 注册采集输出，name 对应配置 collector.switch，重复注册时保留首次注册
+func RegisterSink(name string, factory SinkFactory) {
+	if _, ok := sinkMap[name]; ok {
+		logger.Runtime.Error(fmt.Sprintf("collector sink already registered:%s", name))
 		return
 	}
-	log.Fatal("collector not exists")
+	sinkMap[name] = factory
+}
+
+// NewCollector 初始化 collector.switch 对应的采集输出并开始批量写入
+func NewCollector(config config.Client) (*Collector, error) {
+	if config.Collector.Switch == "" {
+		return nil, SinkNotSetErr
+	}
+	factory, ok := sinkMap[config.Collector.Switch]
+	if !ok {
+		return nil, fmt.Errorf("%w:%s", SinkNotExistsErr, config.Collector.Switch)
+	}
+	sink := factory()
+	if err := sink.Init(config.Collector, config.Collector.Sinks[config.Collector.Switch]); err != nil {
+		return nil, err
+	}
+	batchSize := config.Collector.BatchSize
+	if batchSize <= 0 {
+		batchSize = config.Collector.Es.BulkMaxCount
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	flushInterval := config.Collector.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	collector := &Collector{
+		dataChan:  make(chan Event, dataChanSize),
+		ctx:       ctx,
+		cancel:    cancel,
+		closeChan: make(chan struct{}, 1),
+	}
+	go func() {
+		collector.run(sink, batchSize, time.Duration(flushInterval)*time.Second)
+		collector.closeChan <- struct{}{}
+	}()
+	return collector, nil
 }
 
-func Write(data EsMsg) {
-	if running {
-		dataChan <- data
+// Emit 写入采集事件，未开启或已停止采集时丢弃
+func (collector *Collector) Emit(event Event) {
+	if collector == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
 	}
+	select {
+	case collector.dataChan <- event:
+	case <-collector.ctx.Done():
+	}
+}
+
+func (collector *Collector) Write(data EsMsg) {
+	collector.Emit(Event{Type: TransmitEvent, Data: data})
+}
+
+func (collector *Collector) WriteRollout(data RolloutMsg) {
+	collector.Emit(Event{Type: RolloutEvent, Data: data})
+}
+
+func (collector *Collector) WriteMetric(data MetricMsg) {
+	collector.Emit(Event{Type: MetricEvent, Data: data})
 }
 
-func Stop() {
-	collectorCancelFunc()
+func (collector *Collector) Stop() {
+	if collector == nil {
+		return
+	}
+	collector.cancel()
 	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
 	select {
 	case <-timer.C:
 		logger.Runtime.Error("stop collector timeout")
-	case <-closeChan:
+	case <-collector.closeChan:
 	}
 	fmt.Println("collector stop")
 }
 
-func register(name string, builder builder) {
-	if _, ok := builderMap[name]; !ok {
-		builderMap[name] = builder
+// run 按批次条数或定时将事件写入sink，停止时写入剩余事件并关闭sink
+func (collector *Collector) run(sink Sink, batchSize int, flushInterval time.Duration) {
+	sema := semaphore.NewWeighted(goroutineLimit)
+	eventSlice := make([]Event, 0, batchSize)
+	writeAsync := func() {
+		if len(eventSlice) == 0 {
+			return
+		}
+		if ok := sema.TryAcquire(goroutineWeight); !ok {
+			logger.Runtime.Error("collector goroutine not enough")
+			return
+		}
+		go func(batch []Event) {
+			defer sema.Release(goroutineWeight)
+			writeBatch(sink, batch)
+		}(eventSlice)
+		eventSlice = make([]Event, 0, batchSize)
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-collector.dataChan:
+			eventSlice = append(eventSlice, event)
+			if len(eventSlice) >= batchSize {
+				writeAsync()
+			}
+		case <-ticker.C:
+			writeAsync()
+		case <-collector.ctx.Done():
+			//清空剩余data
+			for len(collector.dataChan) > 0 {
+				eventSlice = append(eventSlice, <-collector.dataChan)
+			}
+			writeBatch(sink, eventSlice)
+			//等待写入中的批次完成
+			_ = sema.Acquire(context.Background(), goroutineLimit)
+			flushCtx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+			if err := sink.Flush(flushCtx); err != nil {
+				logger.Runtime.Error("collector flush err:" + err.Error())
+			}
+			cancel()
+			if err := sink.Close(); err != nil {
+				logger.Runtime.Error("collector close err:" + err.Error())
+			}
+			logger.Runtime.Info("collector sink close!")
+			return
+		}
+	}
+}
+
+func writeBatch(sink Sink, eventSlice []Event) {
+	if len(eventSlice) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	if err := sink.WriteBatch(ctx, eventSlice); err != nil {
+		logger.Runtime.Error("collector write err:" + err.Error())
 	}
 }
@@ -2,9 +2,11 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -39,16 +41,17 @@ func TestMain(m *testing.M) {
 }
 
 func TestRegister(t *testing.T) {
-	Convey("check builderMap", t, func() {
-		fmt.Println(len(builderMap))
-		fmt.Println(builderMap)
-		So(len(builderMap), ShouldEqual, 1)
+	Convey("check sinkMap", t, func() {
+		fmt.Println(len(sinkMap))
+		_, ok := sinkMap[esOutputer]
+		So(ok, ShouldBeTrue)
 	})
 }
 
 func TestEs(t *testing.T) {
 	Convey("new collector", t, func() {
-		NewCollector(*proxyConfig)
+		esCollector, err := NewCollector(*proxyConfig)
+		So(err, ShouldBeNil)
 		Convey("clear es", func() {
 			esClient.DeleteIndex(proxyConfig.Collector.Es.Index).Do(context.Background())
 			Convey("write data", func() {
@@ -60,7 +63,7 @@ func TestEs(t *testing.T) {
 					Name: "te",
 					Age:  10,
 				}
-				dataChan <- b
+				esCollector.Emit(Event{Type: "test", Data: b})
 				Convey("wait for flush", func() {
 					time.Sleep(7 * time.Second)
 					Convey("check es data", func() {
@@ -76,9 +79,88 @@ func TestEs(t *testing.T) {
 							So(val.(w).Name, ShouldEqual, "te")
 						}
 						esClient.DeleteIndex(proxyConfig.Collector.Es.Index).Do(context.Background())
+						esCollector.Stop()
 					})
 				})
 			})
 		})
 	})
 }
+
+type memorySink struct {
+	mu         sync.Mutex
+	eventSlice []Event
+	flushed    bool
+	closed     bool
+}
+
+func (sink *memorySink) Init(collectorConfig config.Collector, params map[string]interface{}) error {
+	return nil
+}
+
+func (sink *memorySink) WriteBatch(ctx context.Context, eventSlice []Event) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.eventSlice = append(sink.eventSlice, eventSlice...)
+	return nil
+}
+
+func (sink *memorySink) Flush(ctx context.Context) error {
+	sink.flushed = true
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	sink.closed = true
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	sinkSlice := make([]*memorySink, 0, 2)
+	RegisterSink("memory", func() Sink {
+		sink := &memorySink{}
+		sinkSlice = append(sinkSlice, sink)
+		return sink
+	})
+	Convey("custom sink", t, func() {
+		memoryConfig := *proxyConfig
+		memoryConfig.Collector.Switch = "memory"
+		memoryConfig.Collector.BatchSize = 2
+		firstCollector, err := NewCollector(memoryConfig)
+		So(err, ShouldBeNil)
+		secondCollector, err := NewCollector(memoryConfig)
+		So(err, ShouldBeNil)
+		firstCollector.Write(EsMsg{ServiceName: "test"})
+		firstCollector.WriteRollout(RolloutMsg{Route: "test"})
+		firstCollector.Emit(Event{Type: "custom", Data: "data"})
+		secondCollector.Emit(Event{Type: "custom", Data: "data"})
+		firstCollector.Stop()
+		secondCollector.Stop()
+		So(len(sinkSlice), ShouldEqual, 2)
+		sink := sinkSlice[0]
+		So(len(sink.eventSlice), ShouldEqual, 3)
+		So(len(sinkSlice[1].eventSlice), ShouldEqual, 1)
+		typeSlice := make([]string, 0, 3)
+		for _, event := range sink.eventSlice {
+			typeSlice = append(typeSlice, event.Type)
+			So(event.Time.IsZero(), ShouldBeFalse)
+		}
+		So(typeSlice, ShouldContain, TransmitEvent)
+		So(typeSlice, ShouldContain, RolloutEvent)
+		So(typeSlice, ShouldContain, "custom")
+		So(sink.flushed, ShouldBeTrue)
+		So(sink.closed, ShouldBeTrue)
+		Convey("stopped collector drops events", func() {
+			firstCollector.Emit(Event{Type: "custom"})
+			var nilCollector *Collector
+			nilCollector.Emit(Event{Type: "custom"})
+			So(len(sink.eventSlice), ShouldEqual, 3)
+		})
+	})
+	Convey("unknown sink", t, func() {
+		unknownConfig := *proxyConfig
+		unknownConfig.Collector.Switch = "unknown"
+		_, err := NewCollector(unknownConfig)
+		So(errors.Is(err, SinkNotExistsErr), ShouldBeTrue)
+	})
+}
@@ -9,7 +9,48 @@ import (
 
 type (
 	ReverseHost struct {
-		ServiceName string `yaml:"service_name"`
+		ServiceName string        `yaml:"service_name"`
+		Split       []SplitStruct `yaml:"split"`  //流量切分，为空时全部转发至service_name
+		Sticky      Sticky        `yaml:"sticky"` //流量切分粘性
+		//按节点标签选择子集，如 {version: v2}
+		Subset map[string]string `yaml:"subset"`
+		//按请求头选择子集，header名称 -> 标签名称，如 {x-version: version}
+		SubsetHeader map[string]string `yaml:"subset_header"`
+		//服务无可用节点时依次尝试的降级服务，均不可用时使用default_url
+		Fallback  []string  `yaml:"fallback"`
+		ErrorPage ErrorPage `yaml:"error_page"`
+		Jwt       Jwt       `yaml:"jwt"` //需启用jwt中间件
+	}
+	Jwt struct {
+		Open           bool     `yaml:"open"`
+		Issuer         string   `yaml:"issuer"`          //为空时不校验iss
+		Audience       []string `yaml:"audience"`        //aud包含任意一个即可，为空时不校验
+		Algorithms     []string `yaml:"algorithms"`      //允许的签名算法，为空时允许 HS256 RS256 ES256 EdDSA
+		RequiredClaims []string `yaml:"required_claims"` //必须存在且不为空的claim
+		Leeway         int      `yaml:"leeway"`          //exp及nbf允许的时钟误差(秒)
+		//密钥文件，HS256为原始密钥，其他算法为PEM格式公钥或证书
+		KeyFiles []JwtKeyFile `yaml:"key_files"`
+		JwksFile string       `yaml:"jwks_file"`
+		JwksUrl  string       `yaml:"jwks_url"`
+		//密钥刷新间隔(秒)，默认300，出现未知kid时提前刷新
+		RefreshInterval int `yaml:"refresh_interval"`
+		//转发至上游的claim，claim名称 -> header名称，请求中携带的同名header会被移除
+		ClaimHeaders map[string]string `yaml:"claim_headers"`
+	}
+	JwtKeyFile struct {
+		Kid       string `yaml:"kid"`
+		Algorithm string `yaml:"algorithm"`
+		Path      string `yaml:"path"`
+	}
+	ErrorPage struct {
+		ContentType string `yaml:"content_type"` //默认application/json，包含html时按html模板转义
+		//go模板，可用字段 .Code .Msg .RequestId .Service .Path .RetryAfter，为空时使用默认json格式
+		Template string `yaml:"template"`
+	}
+	Sticky struct {
+		Mode   string `yaml:"mode"`    //cookie 或 header，为空时不保持粘性
+		Key    string `yaml:"key"`     //cookie名称或header名称
+		MaxAge int    `yaml:"max_age"` //cookie有效期(秒)
 	}
 	Etcd struct {
 		Endpoints                   []string `yaml:"endpoints"`
@@ -36,6 +77,55 @@ type (
 		Rate     int  `yaml:"rate"`
 		MaxToken int  `yaml:"max_token"`
 		WaitTime int  `yaml:"wait_time"`
+		//限流算法：token_bucket(默认)、sliding_window_log、sliding_window_counter
+		Algorithm string `yaml:"algorithm"`
+		//滑动窗口限额，可同时配置多个窗口，如每秒10次且每小时1000次，滑动窗口算法时必须配置
+		Windows []RestrictorWindow `yaml:"windows"`
+		//限流维度：为空时全局共用，ip、consumer(未认证时按ip)、header(为空时按ip)、route
+		Key         string `yaml:"key"`
+		KeyHeader   string `yaml:"key_header"`   //key为header时读取的header
+		MaxKeys     int    `yaml:"max_keys"`     //最多保存的限流key数，超出时回收最久未使用的，默认10000
+		IdleTimeout int    `yaml:"idle_timeout"` //限流key空闲回收时间(秒)，默认600
+		//路由限流，覆盖 rate 及 max_token
+		Routes map[string]RestrictorLimit `yaml:"routes"`
+		//接入方等级限流，按接入方 tier 匹配，优先于路由限流
+		Tiers map[string]RestrictorLimit `yaml:"tiers"`
+		//集群限流，各网关实例按etcd中存活实例数均分限额
+		Cluster RestrictorCluster `yaml:"cluster"`
+		//令牌桶等待令牌时的排队，按等级优先放行
+		Queue RestrictorQueue `yaml:"queue"`
+	}
+	RestrictorQueue struct {
+		MaxSize int `yaml:"max_size"` //每个限流key最多排队的请求数，默认100，超出时直接限流
+		//排队等级，按配置顺序优先级递减，未匹配任何等级的请求优先级最低，最长排队 wait_time
+		Classes []RestrictorQueueClass `yaml:"classes"`
+	}
+	RestrictorQueueClass struct {
+		Name      string            `yaml:"name"`
+		MaxWait   int               `yaml:"max_wait"`  //最长排队时间(秒)，0为不排队
+		Routes    []string          `yaml:"routes"`    //按路由匹配
+		Consumers []string          `yaml:"consumers"` //按接入方id匹配
+		Tiers     []string          `yaml:"tiers"`     //按接入方等级匹配
+		Headers   map[string]string `yaml:"headers"`   //按header匹配，值为空时只需存在该header
+	}
+	RestrictorCluster struct {
+		Open         bool `yaml:"open"`
+		MemberTtl    int  `yaml:"member_ttl"`    //实例租约时间(秒)，默认10，etcd不可用超过该时间后各实例按本地限额限流
+		SyncInterval int  `yaml:"sync_interval"` //续约及同步实例数间隔(秒)，默认为租约时间的1/3
+	}
+	RestrictorLimit struct {
+		Rate     int                `yaml:"rate"`
+		MaxToken int                `yaml:"max_token"`
+		Windows  []RestrictorWindow `yaml:"windows"` //滑动窗口算法使用
+	}
+	RestrictorWindow struct {
+		Limit  int `yaml:"limit"`
+		Window int `yaml:"window"` //窗口长度(秒)
+	}
+	Middleware struct {
+		Name   string                 `yaml:"name"`
+		Open   bool                   `yaml:"open"`
+		Params map[string]interface{} `yaml:"params"` //自定义中间件参数，通过 middleware.DecodeParams 解析
 	}
 	ElasticSearch struct {
 		Username     string `yaml:"username"`
@@ -45,22 +135,69 @@ type (
 		Index        string `yaml:"index"`
 		BulkMaxCount int    `yaml:"bulk_max_count"`
 	}
+	Rollout struct {
+		Route            string  `yaml:"route"`
+		BaselineService  string  `yaml:"baseline_service"`
+		CanaryService    string  `yaml:"canary_service"`
+		Steps            []int   `yaml:"steps"`               //canary流量百分比，如 [1,5,25,50,100]
+		StepInterval     int     `yaml:"step_interval"`       //每步观察时间(秒)
+		MinRequests      int64   `yaml:"min_requests"`        //canary及baseline请求数均达到该值才判断，不足时保持当前步骤继续累计，默认100
+		MaxErrorRateDiff float64 `yaml:"max_error_rate_diff"` //canary错误率允许超出baseline的差值
+		MaxLatencyRatio  float64 `yaml:"max_latency_ratio"`   //canary平均耗时允许为baseline的倍数
+		MaxHoldSteps     int     `yaml:"max_hold_steps"`      //数据不足时最多保持次数，超出则回滚
+	}
+	ZoneAware struct {
+		Open              bool `yaml:"open"`
+		MinHealthyPercent int  `yaml:"min_healthy_percent"` //同区域健康节点占比低于该值时溢出至其他区域
+	}
+	SessionAffinity struct {
+		Open       bool   `yaml:"open"`
+		CookieName string `yaml:"cookie_name"`
+		Secret     string `yaml:"secret"` //cookie签名密钥，多实例需保持一致
+		Ttl        int    `yaml:"ttl"`    //会话保持时间(秒)
+	}
+	Admin struct {
+		Open  bool   `yaml:"open"`
+		Token string `yaml:"token"` //请求头Admin-Token校验，开启时必须配置
+	}
 	Collector struct {
-		Switch string        `yaml:"switch"`
-		Es     ElasticSearch `yaml:"es"`
+		Switch         string                            `yaml:"switch"`          //使用的采集输出，对应 collector.RegisterSink 注册名称
+		BatchSize      int                               `yaml:"batch_size"`      //批量写入条数，为0时使用es.bulk_max_count
+		FlushInterval  int                               `yaml:"flush_interval"`  //定时写入间隔(秒)
+		MetricInterval int                               `yaml:"metric_interval"` //中间件指标采集间隔(秒)，默认10
+		Es             ElasticSearch                     `yaml:"es"`
+		Sinks          map[string]map[string]interface{} `yaml:"sinks"` //自定义采集输出参数，key为注册名称
+	}
+	Tls struct {
+		Open     bool   `yaml:"open"`
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		//客户端证书签发CA(PEM)，为空时不要求客户端证书
+		ClientCaFiles []string `yaml:"client_ca_files"`
+		//require 握手时必须提供有效客户端证书；默认 verify_if_given，提供时校验，由mtls中间件按路由要求
+		ClientAuth string `yaml:"client_auth"`
 	}
 	Client struct {
-		ReverseHost     []ReverseHost `yaml:"reverse_host"`
-		Etcd            Etcd          `yaml:"etcd"`
-		TimeOut         int           `yaml:"timeout"`
-		Port            string        `yaml:"port"`
-		LoadBalanceMode string        `yaml:"load_balance_mode"`
-		DefaultUrl      string        `yaml:"default_url"`
-		HttpTransport   HttpTransport `yaml:"http_transport"`
-		IpTable         []string      `yaml:"ip_table"`
-		Restrictor      Restrictor    `yaml:"restrictor"`
-		OpenCollector   bool          `yaml:"open_collector"`
-		Collector       Collector     `yaml:"collector"`
+		ReverseHost     []ReverseHost   `yaml:"reverse_host"`
+		Etcd            Etcd            `yaml:"etcd"`
+		TimeOut         int             `yaml:"timeout"`
+		Port            string          `yaml:"port"`
+		LoadBalanceMode string          `yaml:"load_balance_mode"`
+		DefaultUrl      string          `yaml:"default_url"`
+		HttpTransport   HttpTransport   `yaml:"http_transport"`
+		IpTable         []string        `yaml:"ip_table"`
+		Restrictor      Restrictor      `yaml:"restrictor"`
+		Middleware      []Middleware    `yaml:"middleware"` //中间件执行顺序，为空时依次执行ip_table、jwt、restrictor
+		OpenCollector   bool            `yaml:"open_collector"`
+		Collector       Collector       `yaml:"collector"`
+		Admin           Admin           `yaml:"admin"`
+		Rollout         []Rollout       `yaml:"rollout"`
+		Zone            string          `yaml:"zone"` //网关所在区域，与节点标签zone匹配
+		ZoneAware       ZoneAware       `yaml:"zone_aware"`
+		SlowStart       int             `yaml:"slow_start"`    //新增节点预热时间(秒)，0为关闭
+		DrainTimeout    int             `yaml:"drain_timeout"` //下线节点继续服务已绑定客户端的时间(秒)
+		SessionAffinity SessionAffinity `yaml:"session_affinity"`
+		Tls             Tls             `yaml:"tls"`
 	}
 )
 
@@ -71,9 +208,73 @@ const (
 	LoadBalanceModeRoundRobin = "round_robin"
 )
 
+const (
+	RestrictorAlgorithmTokenBucket          = "token_bucket"
+	RestrictorAlgorithmSlidingWindowLog     = "sliding_window_log"
+	RestrictorAlgorithmSlidingWindowCounter = "sliding_window_counter"
+)
+
+const (
+	RestrictorKeyIp       = "ip"
+	RestrictorKeyConsumer = "consumer"
+	RestrictorKeyHeader   = "header"
+	RestrictorKeyRoute    = "route"
+)
+
+const (
+	ClientAuthRequire       = "require"
+	ClientAuthVerifyIfGiven = "verify_if_given"
+)
+
+const (
+	StickyModeCookie = "cookie"
+	StickyModeHeader = "header"
+)
+
 type ServiceUrlStruct struct {
-	Url    string
-	Weight int
+	Url       string
+	Weight    int
+	Labels    map[string]string `json:",omitempty"` //节点标签，如 version、zone
+	Draining  bool              `json:",omitempty"` //下线中，不再分配新的请求
+	DrainTime int64             `json:",omitempty"` //开始下线的时间(unix秒)，各网关实例据此计算 drain_timeout
+	Priority  int               `json:",omitempty"` //优先级分组，0为主节点，数值越大越靠后，仅在前序分组全部不可用时启用
+}
+
+type SplitStruct struct {
+	ServiceName string `yaml:"service_name" json:"service_name"`
+	Weight      int    `yaml:"weight" json:"weight"`
+}
+
+// Consumer 接入方，etcd中保存于 consumer/接入方id，api key仅保存sha256摘要(hex)
+type Consumer struct {
+	Id        string   `json:"id"`
+	KeyHashes []string `json:"key_hashes"`
+	//客户端证书标识，sha256:证书指纹(hex)、san:DNS/URI/邮箱/IP 或 cn:证书主体CN
+	Certificates []string `json:"certificates,omitempty"`
+	//hmac请求签名密钥，key id -> 密钥，etcd中为明文，需限制etcd访问权限
+	SigningKeys map[string]string `json:"signing_keys,omitempty"`
+	Routes      []string          `json:"routes"` //允许访问的路由，* 为全部路由
+	Tier        string            `json:"tier"`   //限流等级
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// AllowRoute 路由是否在允许范围内
+func (consumer Consumer) AllowRoute(routeName string) bool {
+	for _, route := range consumer.Routes {
+		if route == "*" || route == routeName {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeParams 将插件配置中的 params 解析至自定义结构体，结构体字段使用yaml标签
+func DecodeParams(params map[string]interface{}, out interface{}) error {
+	paramsYaml, err := yaml.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(paramsYaml, out)
 }
 
 func LoadConf(config *Client, configFileName string) {
@@ -4,8 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,37 +21,88 @@ type ServiceDiscover interface {
 	Get(serviceName string) (ServiceMapStruct, error)
 	Exit()
 	Delete(serviceName string)
-	discoverAllServices(serviceConfig config.Client)
+	GetSplit(routeName string) []config.SplitStruct
+	PutSplit(routeName string, splitSlice []config.SplitStruct) error
+	SetDraining(serviceName string, url string, draining bool) error
 }
 
 type (
 	ServiceMapStruct struct {
 		ServiceUrlSlice []config.ServiceUrlStruct
+		AddTimeMap      map[string]time.Time //节点加入时间，启动时已存在的节点为零值
+		DrainTimeMap    map[string]time.Time //节点开始下线的时间
 	}
 	LocalCache struct {
-		stop          chan struct{}
-		closeComplete chan struct{}
-		localCache    *cache.Cache
+		client                *clientv3.Client
+		consumerMu            sync.RWMutex
+		consumerMap           map[string]config.Consumer //接入方id -> 接入方
+		consumerKeyMap        map[string]string          //api key摘要 -> 接入方id
+		consumerCertMap       map[string]string          //客户端证书标识 -> 接入方id
+		consumerSigningKeyMap map[string]string          //签名key id -> 接入方id
+		expirationTime        time.Duration
+		stop                  chan struct{}
+		stopOnce              sync.Once
+		closeComplete         chan struct{}
+		localCache            *cache.Cache
+		splitCache            *cache.Cache
+		configSplitMap        map[string][]config.SplitStruct
+		addTimeMap            sync.Map
+		drainTimeMap          sync.Map
+		memberMu              sync.RWMutex
+		memberId              string
+		memberTtl             time.Duration //为0时未开启集群限流
+		memberCount           int
+		memberSyncTime        time.Time
+		memberWg              sync.WaitGroup
+		watchMu               sync.Mutex
+		watchMap              map[string]struct{} //已监听的服务，流量切分新增目标服务时补充监听
+		watchClosed           bool
+		watchWg               sync.WaitGroup
+		rolloutMu             sync.Mutex
+		rolloutLeaseMap       map[string]clientv3.LeaseID //路由 -> 发布控制权租约
 	}
 )
 
-var (
-	etcdHandler              *clientv3.Client
-	localCacheExpirationTime time.Duration
+const (
+	// SplitKeyPrefix 流量切分配置在etcd中的key前缀，完整key为 SplitKeyPrefix + 路由名称
+	SplitKeyPrefix = "split/"
+	// ConsumerKeyPrefix 接入方在etcd中的key前缀，完整key为 ConsumerKeyPrefix + 接入方id
+	ConsumerKeyPrefix = "consumer/"
 )
 
 var (
-	ServiceNotFoundErr = errors.New("service not found")
-	etcdInitError      = errors.New("etcd initialization failure")
+	ServiceNotFoundErr  = errors.New("service not found")
+	EndpointNotFoundErr = errors.New("endpoint not found")
+	ConflictErr         = errors.New("service data changed, retry later")
+	EtcdInitErr         = errors.New("etcd initialization failure")
 )
 
-func NewEtcd(serviceConfig config.Client) ServiceDiscover {
-	var err error
+// NewEtcd 连接etcd并加载路由服务，每次调用返回独立的客户端及本地缓存
+func NewEtcd(serviceConfig config.Client) (ServiceDiscover, error) {
 	etcdConfig := serviceConfig.Etcd
-	localCacheExpirationTime = time.Duration(etcdConfig.LocalCacheDefaultExpiration) * time.Second
-	localCache := cache.New(localCacheExpirationTime, time.Duration(etcdConfig.LocalCacheCleanUpTime)*time.Second)
-	localCacheStruct := &LocalCache{stop: make(chan struct{}, 1), localCache: localCache, closeComplete: make(chan struct{}, 1)}
-	etcdHandler, err = clientv3.New(clientv3.Config{
+	expirationTime := time.Duration(etcdConfig.LocalCacheDefaultExpiration) * time.Second
+	localCache := cache.New(expirationTime, time.Duration(etcdConfig.LocalCacheCleanUpTime)*time.Second)
+	localCacheStruct := &LocalCache{
+		expirationTime:        expirationTime,
+		stop:                  make(chan struct{}, 1),
+		localCache:            localCache,
+		closeComplete:         make(chan struct{}, 1),
+		splitCache:            cache.New(cache.NoExpiration, 0),
+		configSplitMap:        make(map[string][]config.SplitStruct),
+		watchMap:              make(map[string]struct{}),
+		consumerMap:           make(map[string]config.Consumer),
+		consumerKeyMap:        make(map[string]string),
+		consumerCertMap:       make(map[string]string),
+		consumerSigningKeyMap: make(map[string]string),
+		rolloutLeaseMap:       make(map[string]clientv3.LeaseID),
+	}
+	for _, host := range serviceConfig.ReverseHost {
+		if len(host.Split) > 0 {
+			localCacheStruct.configSplitMap[host.ServiceName] = host.Split
+			localCacheStruct.splitCache.Set(host.ServiceName, host.Split, cache.NoExpiration)
+		}
+	}
+	client, err := clientv3.New(clientv3.Config{
 		Username:             etcdConfig.UserName,
 		Password:             etcdConfig.Password,
 		Endpoints:            etcdConfig.Endpoints,
@@ -61,12 +111,17 @@ func NewEtcd(serviceConfig config.Client) ServiceDiscover {
 	})
 	if err != nil {
 		logger.Runtime.Error(err.Error())
-		log.Fatal(etcdInitError)
+		return nil, fmt.Errorf("%w:%s", EtcdInitErr, err.Error())
 	}
+	localCacheStruct.client = client
 	localCacheStruct.discoverAllServices(serviceConfig)
-	go localCacheStruct.watch(serviceConfig.ReverseHost, localCacheExpirationTime)
-	runtime.SetFinalizer(localCacheStruct, (*LocalCache).Exit)
-	return localCacheStruct
+	localCacheStruct.discoverAllSplits()
+	localCacheStruct.discoverAllConsumers()
+	go localCacheStruct.watch(serviceConfig.ReverseHost)
+	if serviceConfig.Restrictor.Cluster.Open {
+		localCacheStruct.startMember(serviceConfig.Restrictor.Cluster)
+	}
+	return localCacheStruct, nil
 }
 
 func (etcdLocalCache *LocalCache) Get(serviceName string) (ServiceMapStruct, error) {
@@ -74,7 +129,7 @@ func (etcdLocalCache *LocalCache) Get(serviceName string) (ServiceMapStruct, err
 		return hostObj.(ServiceMapStruct), nil
 	}
 	//缓存不存在则更新缓存
-	etcdLocalCache.discoverService(serviceName, localCacheExpirationTime)
+	etcdLocalCache.discoverService(serviceName, etcdLocalCache.expirationTime)
 	if hostObj, ok := etcdLocalCache.localCache.Get(serviceName); ok {
 		return hostObj.(ServiceMapStruct), nil
 	}
@@ -86,17 +141,117 @@ func (etcdLocalCache *LocalCache) Delete(serviceName string) {
 	etcdLocalCache.localCache.Delete(serviceName)
 }
 
-func (etcdLocalCache *LocalCache) Exit() {
-	close(etcdLocalCache.stop)
-	closeTimer := time.NewTimer(10 * time.Second)
-	select {
-	case <-etcdLocalCache.closeComplete:
-	case <-closeTimer.C:
-		logger.Runtime.Error("etcd watcher stop timeout!")
+// GetSplit 获取路由的流量切分配置，etcd中存在时优先于配置文件
+func (etcdLocalCache *LocalCache) GetSplit(routeName string) []config.SplitStruct {
+	if splitObj, ok := etcdLocalCache.splitCache.Get(routeName); ok {
+		return splitObj.([]config.SplitStruct)
 	}
-	etcdLocalCache.localCache.Flush()
-	etcdHandler.Close()
-	fmt.Println("etcd stop!")
+	return nil
+}
+
+// PutSplit 写入etcd，各网关实例通过watch同步
+func (etcdLocalCache *LocalCache) PutSplit(routeName string, splitSlice []config.SplitStruct) error {
+	jsonStr, err := jsoniter.Marshal(splitSlice)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err = etcdLocalCache.client.Put(ctx, SplitKeyPrefix+routeName, string(jsonStr)); err != nil {
+		return err
+	}
+	etcdLocalCache.splitCache.Set(routeName, splitSlice, cache.NoExpiration)
+	return nil
+}
+
+// GetConsumerByKeyHash 按api key摘要查询接入方
+func (etcdLocalCache *LocalCache) GetConsumerByKeyHash(keyHash string) (config.Consumer, bool) {
+	etcdLocalCache.consumerMu.RLock()
+	defer etcdLocalCache.consumerMu.RUnlock()
+	consumer, ok := etcdLocalCache.consumerMap[etcdLocalCache.consumerKeyMap[keyHash]]
+	return consumer, ok
+}
+
+// GetConsumerByCertificate 按客户端证书标识查询接入方，标识格式为 sha256:指纹、san:名称 或 cn:名称
+func (etcdLocalCache *LocalCache) GetConsumerByCertificate(identity string) (config.Consumer, bool) {
+	etcdLocalCache.consumerMu.RLock()
+	defer etcdLocalCache.consumerMu.RUnlock()
+	consumer, ok := etcdLocalCache.consumerMap[etcdLocalCache.consumerCertMap[certificateIndexKey(identity)]]
+	return consumer, ok
+}
+
+// GetConsumerBySigningKey 按签名key id查询接入方，密钥位于接入方的 SigningKeys
+func (etcdLocalCache *LocalCache) GetConsumerBySigningKey(keyId string) (config.Consumer, bool) {
+	etcdLocalCache.consumerMu.RLock()
+	defer etcdLocalCache.consumerMu.RUnlock()
+	consumer, ok := etcdLocalCache.consumerMap[etcdLocalCache.consumerSigningKeyMap[keyId]]
+	return consumer, ok
+}
+
+// SetDraining 修改etcd中节点的下线标记及开始下线时间，保留原有租约，重复标记时不重置开始时间
+func (etcdLocalCache *LocalCache) SetDraining(serviceName string, url string, draining bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	res, err := etcdLocalCache.client.Get(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	if len(res.Kvs) == 0 {
+		return ServiceNotFoundErr
+	}
+	kv := res.Kvs[0]
+	serviceUrlSlice := make([]config.ServiceUrlStruct, 0)
+	if err = jsoniter.Unmarshal(kv.Value, &serviceUrlSlice); err != nil {
+		return err
+	}
+	found := false
+	for i := range serviceUrlSlice {
+		if serviceUrlSlice[i].Url == url {
+			if !draining {
+				serviceUrlSlice[i].DrainTime = 0
+			} else if !serviceUrlSlice[i].Draining || serviceUrlSlice[i].DrainTime == 0 {
+				serviceUrlSlice[i].DrainTime = time.Now().Unix()
+			}
+			serviceUrlSlice[i].Draining = draining
+			found = true
+		}
+	}
+	if !found {
+		return EndpointNotFoundErr
+	}
+	jsonStr, err := jsoniter.Marshal(serviceUrlSlice)
+	if err != nil {
+		return err
+	}
+	txnRes, err := etcdLocalCache.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(serviceName), "=", kv.ModRevision)).
+		Then(clientv3.OpPut(serviceName, string(jsonStr), clientv3.WithIgnoreLease())).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnRes.Succeeded {
+		return ConflictErr
+	}
+	return nil
+}
+
+// Exit 停止监听并关闭客户端，重复调用时只执行一次
+func (etcdLocalCache *LocalCache) Exit() {
+	etcdLocalCache.stopOnce.Do(func() {
+		close(etcdLocalCache.stop)
+		closeTimer := time.NewTimer(10 * time.Second)
+		defer closeTimer.Stop()
+		select {
+		case <-etcdLocalCache.closeComplete:
+		case <-closeTimer.C:
+			logger.Runtime.Error("etcd watcher stop timeout!")
+		}
+		etcdLocalCache.memberWg.Wait()
+		etcdLocalCache.localCache.Flush()
+		etcdLocalCache.client.Close()
+		fmt.Println("etcd stop!")
+	})
 }
 
 func (etcdLocalCache *LocalCache) discoverAllServices(serviceConfig config.Client) {
@@ -114,7 +269,7 @@ func (etcdLocalCache *LocalCache) discoverAllServices(serviceConfig config.Clien
 
 func (etcdLocalCache *LocalCache) discoverService(serviceName string, timeout time.Duration) {
 	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-	res, err := etcdHandler.Get(ctx, serviceName)
+	res, err := etcdLocalCache.client.Get(ctx, serviceName)
 	if err != nil {
 		logger.Runtime.Error("discover service err:" + err.Error())
 		return
@@ -126,54 +281,293 @@ func (etcdLocalCache *LocalCache) discoverService(serviceName string, timeout ti
 	if len(serviceUrlSlice) > 0 {
 		serviceMapStruct := ServiceMapStruct{
 			ServiceUrlSlice: serviceUrlSlice,
+			AddTimeMap:      etcdLocalCache.markAddTime(serviceName, serviceUrlSlice),
+			DrainTimeMap:    etcdLocalCache.markDrainTime(serviceName, serviceUrlSlice),
 		}
 		etcdLocalCache.localCache.Set(serviceName, serviceMapStruct, timeout)
 	}
 }
 
+func (etcdLocalCache *LocalCache) discoverAllSplits() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	res, err := etcdLocalCache.client.Get(ctx, SplitKeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		logger.Runtime.Error("discover split err:" + err.Error())
+		return
+	}
+	for _, kv := range res.Kvs {
+		etcdLocalCache.setSplit(string(kv.Key), kv.Value)
+	}
+}
+
+func (etcdLocalCache *LocalCache) setSplit(key string, value []byte) {
+	splitSlice := make([]config.SplitStruct, 0)
+	if err := jsoniter.Unmarshal(value, &splitSlice); err != nil {
+		logger.Runtime.Error("split data err:" + err.Error())
+		return
+	}
+	etcdLocalCache.splitCache.Set(strings.TrimPrefix(key, SplitKeyPrefix), splitSlice, cache.NoExpiration)
+	for _, split := range splitSlice {
+		etcdLocalCache.watchService(split.ServiceName)
+	}
+}
+
+func (etcdLocalCache *LocalCache) discoverAllConsumers() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	res, err := etcdLocalCache.client.Get(ctx, ConsumerKeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		logger.Runtime.Error("discover consumer err:" + err.Error())
+		return
+	}
+	for _, kv := range res.Kvs {
+		etcdLocalCache.setConsumer(string(kv.Key), kv.Value)
+	}
+}
+
+// setConsumer 更新接入方并重建其api key索引，接入方id以etcd key为准
+func (etcdLocalCache *LocalCache) setConsumer(key string, value []byte) {
+	consumer := config.Consumer{}
+	if err := jsoniter.Unmarshal(value, &consumer); err != nil {
+		logger.Runtime.Error("consumer data err:" + err.Error())
+		return
+	}
+	id := strings.TrimPrefix(key, ConsumerKeyPrefix)
+	consumer.Id = id
+	//空密钥任何人都可伪造签名，忽略
+	for keyId, secret := range consumer.SigningKeys {
+		if secret == "" {
+			logger.Runtime.Error(fmt.Sprintf("consumer %s signing key %s is empty, ignored", id, keyId))
+			delete(consumer.SigningKeys, keyId)
+		}
+	}
+	etcdLocalCache.consumerMu.Lock()
+	defer etcdLocalCache.consumerMu.Unlock()
+	etcdLocalCache.deleteConsumerLocked(id)
+	etcdLocalCache.consumerMap[id] = consumer
+	for _, keyHash := range consumer.KeyHashes {
+		etcdLocalCache.consumerKeyMap[strings.ToLower(keyHash)] = id
+	}
+	for _, identity := range consumer.Certificates {
+		etcdLocalCache.consumerCertMap[certificateIndexKey(identity)] = id
+	}
+	for keyId := range consumer.SigningKeys {
+		etcdLocalCache.consumerSigningKeyMap[keyId] = id
+	}
+}
+
+func (etcdLocalCache *LocalCache) deleteConsumer(key string) {
+	etcdLocalCache.consumerMu.Lock()
+	defer etcdLocalCache.consumerMu.Unlock()
+	etcdLocalCache.deleteConsumerLocked(strings.TrimPrefix(key, ConsumerKeyPrefix))
+}
+
+func (etcdLocalCache *LocalCache) deleteConsumerLocked(id string) {
+	if consumer, ok := etcdLocalCache.consumerMap[id]; ok {
+		for _, keyHash := range consumer.KeyHashes {
+			if etcdLocalCache.consumerKeyMap[strings.ToLower(keyHash)] == id {
+				delete(etcdLocalCache.consumerKeyMap, strings.ToLower(keyHash))
+			}
+		}
+		for _, identity := range consumer.Certificates {
+			if etcdLocalCache.consumerCertMap[certificateIndexKey(identity)] == id {
+				delete(etcdLocalCache.consumerCertMap, certificateIndexKey(identity))
+			}
+		}
+		for keyId := range consumer.SigningKeys {
+			if etcdLocalCache.consumerSigningKeyMap[keyId] == id {
+				delete(etcdLocalCache.consumerSigningKeyMap, keyId)
+			}
+		}
+		delete(etcdLocalCache.consumerMap, id)
+	}
+}
+
+// certificateIndexKey 证书指纹不区分大小写，其余标识原样匹配
+func certificateIndexKey(identity string) string {
+	if strings.HasPrefix(strings.ToLower(identity), "sha256:") {
+		return strings.ToLower(identity)
+	}
+	return identity
+}
+
+// etcd中删除切分配置后回退至配置文件
+func (etcdLocalCache *LocalCache) resetSplit(key string) {
+	routeName := strings.TrimPrefix(key, SplitKeyPrefix)
+	if splitSlice, ok := etcdLocalCache.configSplitMap[routeName]; ok {
+		etcdLocalCache.splitCache.Set(routeName, splitSlice, cache.NoExpiration)
+		return
+	}
+	etcdLocalCache.splitCache.Delete(routeName)
+}
+
 func (etcdLocalCache *LocalCache) removeService(serviceName string) {
 	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-	_, err := etcdHandler.Delete(ctx, serviceName)
+	_, err := etcdLocalCache.client.Delete(ctx, serviceName)
 	if err != nil {
 		logger.Runtime.Error("delete service err:" + err.Error())
 	}
 }
 
 // 监听服务变化
-func (etcdLocalCache *LocalCache) watch(reverseHost []config.ReverseHost, timeout time.Duration) {
+func (etcdLocalCache *LocalCache) watch(reverseHost []config.ReverseHost) {
 	var wg sync.WaitGroup
-	for _, host := range reverseHost {
-		host := host
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			watchChan := etcdHandler.Watch(context.TODO(), host.ServiceName)
-		LOOP:
-			for {
-				select {
-				case watchRes := <-watchChan:
-					etcdEventHandle(etcdLocalCache.localCache, watchRes.Events, timeout)
-				case <-etcdLocalCache.stop:
-					break LOOP
+	for _, serviceName := range watchServiceNames(reverseHost) {
+		etcdLocalCache.watchService(serviceName)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchChan := etcdLocalCache.client.Watch(context.TODO(), SplitKeyPrefix, clientv3.WithPrefix())
+	LOOP:
+		for {
+			select {
+			case watchRes := <-watchChan:
+				for _, ev := range watchRes.Events {
+					if ev.Type == mvccpb.PUT {
+						etcdLocalCache.setSplit(string(ev.Kv.Key), ev.Kv.Value)
+					} else {
+						etcdLocalCache.resetSplit(string(ev.Kv.Key))
+					}
 				}
+			case <-etcdLocalCache.stop:
+				break LOOP
 			}
-		}()
-	}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchChan := etcdLocalCache.client.Watch(context.TODO(), ConsumerKeyPrefix, clientv3.WithPrefix())
+	LOOP:
+		for {
+			select {
+			case watchRes := <-watchChan:
+				for _, ev := range watchRes.Events {
+					if ev.Type == mvccpb.PUT {
+						etcdLocalCache.setConsumer(string(ev.Kv.Key), ev.Kv.Value)
+					} else {
+						etcdLocalCache.deleteConsumer(string(ev.Kv.Key))
+					}
+				}
+			case <-etcdLocalCache.stop:
+				break LOOP
+			}
+		}
+	}()
 	wg.Wait()
+	etcdLocalCache.watchMu.Lock()
+	etcdLocalCache.watchClosed = true
+	etcdLocalCache.watchMu.Unlock()
+	etcdLocalCache.watchWg.Wait()
 	etcdLocalCache.closeComplete <- struct{}{}
 }
 
-func etcdEventHandle(cache *cache.Cache, events []*clientv3.Event, timeout time.Duration) {
+// watchService 监听单个服务，已监听或已停止时忽略，运行时新增的流量切分目标服务由此补充监听
+func (etcdLocalCache *LocalCache) watchService(serviceName string) {
+	etcdLocalCache.watchMu.Lock()
+	defer etcdLocalCache.watchMu.Unlock()
+	if _, ok := etcdLocalCache.watchMap[serviceName]; ok || etcdLocalCache.watchClosed || serviceName == "" {
+		return
+	}
+	etcdLocalCache.watchMap[serviceName] = struct{}{}
+	etcdLocalCache.watchWg.Add(1)
+	go func() {
+		defer etcdLocalCache.watchWg.Done()
+		watchChan := etcdLocalCache.client.Watch(context.TODO(), serviceName)
+		for {
+			select {
+			case watchRes := <-watchChan:
+				etcdLocalCache.etcdEventHandle(watchRes.Events, etcdLocalCache.expirationTime)
+			case <-etcdLocalCache.stop:
+				return
+			}
+		}
+	}()
+}
+
+// 需监听的服务，包含流量切分的目标服务
+func watchServiceNames(reverseHost []config.ReverseHost) []string {
+	serviceNameSlice := make([]string, 0, len(reverseHost))
+	exists := make(map[string]struct{})
+	for _, host := range reverseHost {
+		nameSlice := []string{host.ServiceName}
+		for _, split := range host.Split {
+			nameSlice = append(nameSlice, split.ServiceName)
+		}
+		for _, name := range nameSlice {
+			if _, ok := exists[name]; !ok {
+				exists[name] = struct{}{}
+				serviceNameSlice = append(serviceNameSlice, name)
+			}
+		}
+	}
+	return serviceNameSlice
+}
+
+func (etcdLocalCache *LocalCache) etcdEventHandle(events []*clientv3.Event, timeout time.Duration) {
 	for _, ev := range events {
+		serviceName := string(ev.Kv.Key)
 		if ev.Type == mvccpb.PUT {
 			serviceUrlSlice := make([]config.ServiceUrlStruct, 0)
 			_ = jsoniter.Unmarshal(ev.Kv.Value, &serviceUrlSlice)
 			serviceMapStruct := ServiceMapStruct{
 				ServiceUrlSlice: serviceUrlSlice,
+				AddTimeMap:      etcdLocalCache.markAddTime(serviceName, serviceUrlSlice),
+				DrainTimeMap:    etcdLocalCache.markDrainTime(serviceName, serviceUrlSlice),
 			}
-			cache.Set(string(ev.Kv.Key), serviceMapStruct, timeout)
+			etcdLocalCache.localCache.Set(serviceName, serviceMapStruct, timeout)
+		} else {
+			//服务重新上线时全部节点视为新增
+			etcdLocalCache.addTimeMap.Store(serviceName, map[string]time.Time{})
+			etcdLocalCache.localCache.Delete(serviceName)
+		}
+	}
+}
+
+// markAddTime 记录节点加入时间，首次发现服务时的节点视为已预热
+func (etcdLocalCache *LocalCache) markAddTime(serviceName string, serviceUrlSlice []config.ServiceUrlStruct) map[string]time.Time {
+	var lastAddTimeMap map[string]time.Time
+	lastObj, known := etcdLocalCache.addTimeMap.Load(serviceName)
+	if known {
+		lastAddTimeMap = lastObj.(map[string]time.Time)
+	}
+	now := time.Now()
+	addTimeMap := make(map[string]time.Time, len(serviceUrlSlice))
+	for _, urlStruct := range serviceUrlSlice {
+		if addTime, ok := lastAddTimeMap[urlStruct.Url]; ok {
+			addTimeMap[urlStruct.Url] = addTime
+		} else if known {
+			addTimeMap[urlStruct.Url] = now
+		} else {
+			addTimeMap[urlStruct.Url] = time.Time{}
+		}
+	}
+	etcdLocalCache.addTimeMap.Store(serviceName, addTimeMap)
+	return addTimeMap
+}
+
+// markDrainTime 记录节点开始下线的时间，优先使用etcd中写入的时间，未写入时(如直接修改etcd)为本实例首次发现的时间
+func (etcdLocalCache *LocalCache) markDrainTime(serviceName string, serviceUrlSlice []config.ServiceUrlStruct) map[string]time.Time {
+	var lastDrainTimeMap map[string]time.Time
+	if lastObj, ok := etcdLocalCache.drainTimeMap.Load(serviceName); ok {
+		lastDrainTimeMap = lastObj.(map[string]time.Time)
+	}
+	now := time.Now()
+	drainTimeMap := make(map[string]time.Time)
+	for _, urlStruct := range serviceUrlSlice {
+		if !urlStruct.Draining {
+			continue
+		}
+		if urlStruct.DrainTime > 0 {
+			drainTimeMap[urlStruct.Url] = time.Unix(urlStruct.DrainTime, 0)
+		} else if drainTime, ok := lastDrainTimeMap[urlStruct.Url]; ok {
+			drainTimeMap[urlStruct.Url] = drainTime
 		} else {
-			cache.Delete(string(ev.Kv.Key))
+			drainTimeMap[urlStruct.Url] = now
 		}
 	}
+	etcdLocalCache.drainTimeMap.Store(serviceName, drainTimeMap)
+	return drainTimeMap
 }
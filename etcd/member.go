@@ -0,0 +1,112 @@
+package etcd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// MemberKeyPrefix 网关实例在etcd中的key前缀，key绑定租约，实例退出或失联后自动删除
+const MemberKeyPrefix = "gateway/members/"
+
+var (
+	defaultMemberTtl = 10
+)
+
+// ClusterSize 当前存活的网关实例数，第二个返回值为false时表示未开启集群限流或超过租约时间未能同步
+func (etcdLocalCache *LocalCache) ClusterSize() (int, bool) {
+	etcdLocalCache.memberMu.RLock()
+	defer etcdLocalCache.memberMu.RUnlock()
+	if etcdLocalCache.memberTtl == 0 || etcdLocalCache.memberCount == 0 {
+		return 1, false
+	}
+	return etcdLocalCache.memberCount, time.Since(etcdLocalCache.memberSyncTime) < etcdLocalCache.memberTtl
+}
+
+// startMember 以租约注册实例，定时续约并同步实例数
+func (etcdLocalCache *LocalCache) startMember(clusterConfig config.RestrictorCluster) {
+	memberTtl := clusterConfig.MemberTtl
+	if memberTtl <= 0 {
+		memberTtl = defaultMemberTtl
+	}
+	syncInterval := time.Duration(clusterConfig.SyncInterval) * time.Second
+	if syncInterval <= 0 {
+		syncInterval = time.Duration(memberTtl) * time.Second / 3
+	}
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	etcdLocalCache.memberId = hostname + "-" + hex.EncodeToString(suffix)
+	etcdLocalCache.memberTtl = time.Duration(memberTtl) * time.Second
+	etcdLocalCache.memberWg.Add(1)
+	go etcdLocalCache.keepMember(int64(memberTtl), syncInterval)
+}
+
+func (etcdLocalCache *LocalCache) keepMember(memberTtl int64, syncInterval time.Duration) {
+	defer etcdLocalCache.memberWg.Done()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	var leaseId clientv3.LeaseID
+	for {
+		leaseId = etcdLocalCache.syncMember(leaseId, memberTtl)
+		select {
+		case <-etcdLocalCache.stop:
+			//退出时撤销租约，其他实例下次同步即可分得限额
+			if leaseId != 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				_, _ = etcdLocalCache.client.Revoke(ctx, leaseId)
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncMember 续约，租约已失效时重新注册，随后统计存活实例数
+func (etcdLocalCache *LocalCache) syncMember(leaseId clientv3.LeaseID, memberTtl int64) clientv3.LeaseID {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if leaseId != 0 {
+		if _, err := etcdLocalCache.client.KeepAliveOnce(ctx, leaseId); errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			leaseId = 0
+		} else if err != nil {
+			logger.Runtime.Error("keep member lease err:" + err.Error())
+			return leaseId
+		}
+	}
+	if leaseId == 0 {
+		lease, err := etcdLocalCache.client.Grant(ctx, memberTtl)
+		if err != nil {
+			logger.Runtime.Error("grant member lease err:" + err.Error())
+			return 0
+		}
+		if _, err = etcdLocalCache.client.Put(ctx, MemberKeyPrefix+etcdLocalCache.memberId, "", clientv3.WithLease(lease.ID)); err != nil {
+			logger.Runtime.Error("register member err:" + err.Error())
+			return 0
+		}
+		leaseId = lease.ID
+	}
+	res, err := etcdLocalCache.client.Get(ctx, MemberKeyPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		logger.Runtime.Error("count member err:" + err.Error())
+		return leaseId
+	}
+	etcdLocalCache.memberMu.Lock()
+	defer etcdLocalCache.memberMu.Unlock()
+	etcdLocalCache.memberCount = int(res.Count)
+	if etcdLocalCache.memberCount < 1 {
+		etcdLocalCache.memberCount = 1
+	}
+	etcdLocalCache.memberSyncTime = time.Now()
+	return leaseId
+}
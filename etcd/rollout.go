@@ -0,0 +1,105 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// RolloutStateKeyPrefix 发布进度在etcd中的key前缀，完整key为 RolloutStateKeyPrefix + 路由名称
+	RolloutStateKeyPrefix = "rollout/state/"
+	// RolloutLeaderKeyPrefix 发布控制主实例在etcd中的key前缀，key绑定租约，主实例退出或失联后由其他实例接管
+	RolloutLeaderKeyPrefix = "rollout/leader/"
+)
+
+// RolloutState 发布进度，网关重启或主实例切换后从该进度继续
+type RolloutState struct {
+	CanaryService string `json:"canary_service"`
+	Steps         []int  `json:"steps"`      //写入时的步骤配置，与当前配置不一致时重新发布
+	StepIndex     int    `json:"step_index"` //当前所处步骤下标
+	Action        string `json:"action"`     //最近一次动作，complete、rollback 表示发布已结束
+}
+
+// GetRolloutState 直接从etcd读取发布进度，第二个返回值为false时表示尚无进度
+func (etcdLocalCache *LocalCache) GetRolloutState(routeName string) (RolloutState, bool, error) {
+	var state RolloutState
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	res, err := etcdLocalCache.client.Get(ctx, RolloutStateKeyPrefix+routeName)
+	if err != nil {
+		return state, false, err
+	}
+	if len(res.Kvs) == 0 {
+		return state, false, nil
+	}
+	if err = jsoniter.Unmarshal(res.Kvs[0].Value, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+// PutRolloutState 写入发布进度
+func (etcdLocalCache *LocalCache) PutRolloutState(routeName string, state RolloutState) error {
+	jsonStr, err := jsoniter.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = etcdLocalCache.client.Put(ctx, RolloutStateKeyPrefix+routeName, string(jsonStr))
+	return err
+}
+
+// CampaignRollout 以租约抢占路由的发布控制权，已持有时续约，返回当前实例是否为主实例
+func (etcdLocalCache *LocalCache) CampaignRollout(routeName string, ttl int64) (bool, error) {
+	etcdLocalCache.rolloutMu.Lock()
+	defer etcdLocalCache.rolloutMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if leaseId, ok := etcdLocalCache.rolloutLeaseMap[routeName]; ok {
+		_, err := etcdLocalCache.client.KeepAliveOnce(ctx, leaseId)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return false, err
+		}
+		delete(etcdLocalCache.rolloutLeaseMap, routeName)
+	}
+	lease, err := etcdLocalCache.client.Grant(ctx, ttl)
+	if err != nil {
+		return false, err
+	}
+	key := RolloutLeaderKeyPrefix + routeName
+	hostname, _ := os.Hostname()
+	res, err := etcdLocalCache.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, hostname, clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil || !res.Succeeded {
+		_, _ = etcdLocalCache.client.Revoke(ctx, lease.ID)
+		return false, err
+	}
+	etcdLocalCache.rolloutLeaseMap[routeName] = lease.ID
+	return true, nil
+}
+
+// ResignRollout 撤销租约释放发布控制权，其他实例下次抢占即可接管
+func (etcdLocalCache *LocalCache) ResignRollout(routeName string) {
+	etcdLocalCache.rolloutMu.Lock()
+	defer etcdLocalCache.rolloutMu.Unlock()
+	leaseId, ok := etcdLocalCache.rolloutLeaseMap[routeName]
+	if !ok {
+		return
+	}
+	delete(etcdLocalCache.rolloutLeaseMap, routeName)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, _ = etcdLocalCache.client.Revoke(ctx, leaseId)
+}
@@ -0,0 +1,57 @@
+// 自定义负载均衡示例：按租户选择分片
+//
+// etcd中节点通过标签声明所属分片：
+//
+//	[{"url":"10.0.0.1:80","weight":1,"labels":{"shard":"0"}},{"url":"10.0.0.2:80","weight":1,"labels":{"shard":"1"}}]
+//
+// 配置文件中按注册名称启用：
+//
+//	load_balance_mode: "tenant_shard"
+package main
+
+import (
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/gateway"
+	"simple_proxygateway/transmit"
+)
+
+const (
+	tenantHeader = "X-Tenant"
+	shardLabel   = "shard"
+)
+
+func init() {
+	transmit.RegisterBalancer("tenant_shard", transmit.BalancerFunc(pickTenantShard))
+}
+
+// pickTenantShard 租户hash后对分片数取模，同一分片内按租户固定节点
+func pickTenantShard(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
+	shardMap := make(map[int][]config.ServiceUrlStruct)
+	for _, urlStruct := range urlSlice {
+		shard, err := strconv.Atoi(urlStruct.Labels[shardLabel])
+		if err != nil {
+			continue
+		}
+		shardMap[shard] = append(shardMap[shard], urlStruct)
+	}
+	if len(shardMap) == 0 {
+		return urlSlice[0].Url
+	}
+	shardSlice := make([]int, 0, len(shardMap))
+	for shard := range shardMap {
+		shardSlice = append(shardSlice, shard)
+	}
+	sort.Ints(shardSlice)
+	tenantHash := crc32.ChecksumIEEE([]byte(req.Header.Get(tenantHeader)))
+	shardUrlSlice := shardMap[shardSlice[int(tenantHash%uint32(len(shardSlice)))]]
+	return shardUrlSlice[int(tenantHash%uint32(len(shardUrlSlice)))].Url
+}
+
+func main() {
+	gateway.Run("config.yaml")
+}
@@ -0,0 +1,49 @@
+// 自定义中间件示例：编译包含自定义中间件的网关
+//
+// 配置文件中按注册名称启用：
+//
+//	middleware:
+//	  - { name: "ip_table", open: true }
+//	  - { name: "require_header", open: true, params: { header: "X-Tenant" } }
+//	  - { name: "restrictor", open: true }
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/gateway"
+	"simple_proxygateway/transmit/middleware"
+)
+
+type requireHeader struct {
+	Header string `yaml:"header"`
+}
+
+func init() {
+	middleware.Register("require_header", func(proxyConfig config.Client, params map[string]interface{}) (middleware.Middleware, error) {
+		handler := requireHeader{}
+		if err := middleware.DecodeParams(params, &handler); err != nil {
+			return nil, err
+		}
+		if handler.Header == "" {
+			return nil, errors.New("header is required")
+		}
+		return handler, nil
+	})
+}
+
+func (handler requireHeader) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(handler.Header) == "" {
+			middleware.Reject(w, r, &middleware.LimitError{Code: http.StatusBadRequest, Msg: handler.Header + " is required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func main() {
+	gateway.Run("config.yaml")
+}
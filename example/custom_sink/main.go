@@ -0,0 +1,80 @@
+// 自定义采集输出示例：按行输出json至标准输出
+//
+// 配置文件中按注册名称启用：
+//
+//	open_collector: true
+//	collector:
+//	  switch: "stdout"
+//	  sinks:
+//	    stdout: { prefix: "gateway" }
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"simple_proxygateway/collector"
+	"simple_proxygateway/config"
+	"simple_proxygateway/gateway"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+type (
+	stdoutParams struct {
+		Prefix string `yaml:"prefix"`
+	}
+	stdoutSink struct {
+		mu     sync.Mutex
+		prefix string
+		writer *bufio.Writer
+	}
+)
+
+func init() {
+	collector.RegisterSink("stdout", func() collector.Sink {
+		return &stdoutSink{}
+	})
+}
+
+func (sink *stdoutSink) Init(collectorConfig config.Collector, params map[string]interface{}) error {
+	stdout := stdoutParams{}
+	if err := config.DecodeParams(params, &stdout); err != nil {
+		return err
+	}
+	sink.prefix = stdout.Prefix
+	sink.writer = bufio.NewWriter(os.Stdout)
+	return nil
+}
+
+func (sink *stdoutSink) WriteBatch(ctx context.Context, eventSlice []collector.Event) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for _, event := range eventSlice {
+		eventJson, err := jsoniter.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(sink.writer, "%s %s\n", sink.prefix, eventJson); err != nil {
+			return err
+		}
+	}
+	return sink.writer.Flush()
+}
+
+func (sink *stdoutSink) Flush(ctx context.Context) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.writer.Flush()
+}
+
+func (sink *stdoutSink) Close() error {
+	return nil
+}
+
+func main() {
+	gateway.Run("config.yaml")
+}
@@ -0,0 +1,267 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"simple_proxygateway/admin"
+	"simple_proxygateway/collector"
+	"simple_proxygateway/config"
+	"simple_proxygateway/etcd"
+	"simple_proxygateway/rollout"
+	"simple_proxygateway/transmit"
+
+	"github.com/arl/statsviz"
+)
+
+type (
+	// Gateway 网关实例，服务发现、转发、采集及发布控制等状态均由实例持有，同一进程内可运行多个实例
+	Gateway struct {
+		proxyConfig       config.Client
+		serviceDiscover   etcd.ServiceDiscover
+		ownDiscover       bool //由实例创建的服务发现在停止时一并关闭
+		collector         *collector.Collector
+		proxy             *transmit.Proxy
+		mux               *http.ServeMux
+		server            *http.Server
+		listener          net.Listener
+		tlsConfig         *tls.Config //开启tls时监听使用
+		rolloutController *rollout.Controller
+		metricStop        chan struct{}
+		metricWg          sync.WaitGroup
+		shutdownOnce      sync.Once
+	}
+	// Option 创建网关实例时的可选配置
+	Option func(gateway *Gateway)
+)
+
+var (
+	defaultMetricInterval = 10
+	AlreadyStartedErr     = errors.New("gateway already started")
+	ClientCaErr           = errors.New("client ca file has no certificate")
+)
+
+// WithServiceDiscover 使用外部的服务发现，不再按配置连接etcd，停止网关时不会关闭
+func WithServiceDiscover(serviceDiscover etcd.ServiceDiscover) Option {
+	return func(gateway *Gateway) {
+		gateway.serviceDiscover = serviceDiscover
+	}
+}
+
+// WithListener 使用外部的监听，不再按配置端口监听
+func WithListener(listener net.Listener) Option {
+	return func(gateway *Gateway) {
+		gateway.listener = listener
+	}
+}
+
+// New 按配置创建网关实例，调用 Start 后开始监听
+func New(proxyConfig config.Client, options ...Option) (*Gateway, error) {
+	gateway := &Gateway{proxyConfig: proxyConfig, metricStop: make(chan struct{})}
+	for _, option := range options {
+		option(gateway)
+	}
+	var err error
+	if proxyConfig.Tls.Open {
+		if gateway.tlsConfig, err = newTlsConfig(proxyConfig.Tls); err != nil {
+			return nil, err
+		}
+	}
+	if gateway.serviceDiscover == nil {
+		if gateway.serviceDiscover, err = etcd.NewEtcd(proxyConfig); err != nil {
+			return nil, err
+		}
+		gateway.ownDiscover = true
+	}
+	if proxyConfig.OpenCollector {
+		if gateway.collector, err = collector.NewCollector(proxyConfig); err != nil {
+			gateway.closeDiscover()
+			return nil, err
+		}
+	}
+	if gateway.proxy, err = transmit.NewProxyHandler(gateway.serviceDiscover, proxyConfig.LoadBalanceMode, proxyConfig, gateway.collector); err != nil {
+		gateway.collector.Stop()
+		gateway.closeDiscover()
+		return nil, err
+	}
+	gateway.mux = http.NewServeMux()
+	gateway.mux.Handle("/", gateway.proxy)
+	if err = statsviz.Register(gateway.mux, statsviz.Root("/go/statsviz")); err != nil {
+		gateway.collector.Stop()
+		gateway.closeDiscover()
+		return nil, err
+	}
+	if proxyConfig.Admin.Open {
+		adminHandler, err := admin.NewAdminHandler(gateway.serviceDiscover, gateway.proxy, proxyConfig.Admin)
+		if err != nil {
+			gateway.collector.Stop()
+			gateway.closeDiscover()
+			return nil, err
+		}
+		gateway.mux.Handle(admin.Prefix, adminHandler)
+	}
+	gateway.server = &http.Server{Addr: proxyConfig.Port, Handler: gateway.mux, TLSConfig: gateway.tlsConfig}
+	return gateway, nil
+}
+
+// newTlsConfig 加载服务端证书及客户端证书CA，校验通过的客户端证书由mtls中间件映射为接入方
+func newTlsConfig(tlsConfig config.Tls) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	serverTlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(tlsConfig.ClientCaFiles) == 0 {
+		return serverTlsConfig, nil
+	}
+	serverTlsConfig.ClientCAs = x509.NewCertPool()
+	for _, caFile := range tlsConfig.ClientCaFiles {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !serverTlsConfig.ClientCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("%w: %s", ClientCaErr, caFile)
+		}
+	}
+	serverTlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if tlsConfig.ClientAuth == config.ClientAuthRequire {
+		serverTlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return serverTlsConfig, nil
+}
+
+// Handler 网关路由，可直接用于 httptest 或挂载至其他服务
+func (gateway *Gateway) Handler() http.Handler {
+	return gateway.mux
+}
+
+// Proxy 转发实例，可获取转发统计
+func (gateway *Gateway) Proxy() *transmit.Proxy {
+	return gateway.proxy
+}
+
+// Collector 采集实例，未开启采集时为nil，可通过 Emit 写入自定义事件
+func (gateway *Gateway) Collector() *collector.Collector {
+	return gateway.collector
+}
+
+// Addr 实际监听地址，Start 之前为nil
+func (gateway *Gateway) Addr() net.Addr {
+	if gateway.listener == nil {
+		return nil
+	}
+	return gateway.listener.Addr()
+}
+
+// Start 开始监听及金丝雀发布控制，监听失败时返回错误
+func (gateway *Gateway) Start() error {
+	if gateway.rolloutController != nil {
+		return AlreadyStartedErr
+	}
+	if gateway.listener == nil {
+		listener, err := net.Listen("tcp", gateway.proxyConfig.Port)
+		if err != nil {
+			return err
+		}
+		gateway.listener = listener
+	}
+	if gateway.tlsConfig != nil {
+		gateway.listener = tls.NewListener(gateway.listener, gateway.tlsConfig)
+	}
+	gateway.rolloutController = rollout.NewController(gateway.serviceDiscover, gateway.proxy, gateway.collector, gateway.proxyConfig)
+	if gateway.collector != nil {
+		gateway.metricWg.Add(1)
+		go gateway.runMetric()
+	}
+	go func() {
+		fmt.Println("server running!")
+		err := gateway.server.Serve(gateway.listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown 停止接收新请求并等待处理中的请求完成，随后停止发布控制、采集及服务发现，未调用 Start 时同样释放资源
+func (gateway *Gateway) Shutdown(ctx context.Context) error {
+	var err error
+	gateway.shutdownOnce.Do(func() {
+		fmt.Println("server stopping!")
+		err = gateway.server.Shutdown(ctx)
+		if gateway.rolloutController != nil {
+			gateway.rolloutController.Stop()
+		}
+		close(gateway.metricStop)
+		gateway.collector.Stop()
+		gateway.metricWg.Wait()
+		gateway.closeDiscover()
+		fmt.Println("server stop!")
+	})
+	return err
+}
+
+// runMetric 定时将中间件指标写入采集
+func (gateway *Gateway) runMetric() {
+	defer gateway.metricWg.Done()
+	interval := gateway.proxyConfig.Collector.MetricInterval
+	if interval <= 0 {
+		interval = defaultMetricInterval
+	}
+	hostname, _ := os.Hostname()
+	gatewayName := hostname + "/" + gateway.Addr().String()
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gateway.metricStop:
+			return
+		case now := <-ticker.C:
+			for name, value := range gateway.proxy.Gauges() {
+				gateway.collector.WriteMetric(collector.MetricMsg{Gateway: gatewayName, Name: name, Value: value, RecordTime: int(now.Unix())})
+			}
+		}
+	}
+}
+
+func (gateway *Gateway) closeDiscover() {
+	if gateway.ownDiscover {
+		gateway.serviceDiscover.Exit()
+	}
+}
+
+// Run 加载配置并启动网关，收到退出信号后停止
+// 自定义网关只需在main包中引入注册了中间件、负载均衡等插件的包后调用Run
+func Run(configFileName string) {
+	proxyConfig := &config.Client{}
+	config.LoadConf(proxyConfig, configFileName)
+	gateway, err := New(*proxyConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = gateway.Start(); err != nil {
+		log.Fatal(err)
+	}
+	signs := make(chan os.Signal, 1)
+	signal.Notify(signs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	<-signs
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(proxyConfig.TimeOut)*time.Second)
+	defer cancel()
+	_ = gateway.Shutdown(ctx)
+}
@@ -0,0 +1,338 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simple_proxygateway/admin"
+	"simple_proxygateway/collector"
+	"simple_proxygateway/config"
+	"simple_proxygateway/etcd"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// memoryDiscover 内存服务发现，测试时替代etcd
+type memoryDiscover struct {
+	serviceMap map[string]etcd.ServiceMapStruct
+}
+
+func (discover *memoryDiscover) Get(serviceName string) (etcd.ServiceMapStruct, error) {
+	if serviceMapStruct, ok := discover.serviceMap[serviceName]; ok {
+		return serviceMapStruct, nil
+	}
+	return etcd.ServiceMapStruct{}, etcd.ServiceNotFoundErr
+}
+
+func (discover *memoryDiscover) Exit() {}
+
+func (discover *memoryDiscover) Delete(serviceName string) {}
+
+func (discover *memoryDiscover) GetSplit(routeName string) []config.SplitStruct {
+	return nil
+}
+
+func (discover *memoryDiscover) PutSplit(routeName string, splitSlice []config.SplitStruct) error {
+	return nil
+}
+
+func (discover *memoryDiscover) SetDraining(serviceName string, url string, draining bool) error {
+	return nil
+}
+
+func newUpstream(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func newTestGateway(upstream *httptest.Server, ipTable []string) (*Gateway, error) {
+	return newTestGatewayWithConfig(upstream, config.Client{
+		LoadBalanceMode: config.LoadBalanceModeRandom,
+		IpTable:         ipTable,
+		ReverseHost:     []config.ReverseHost{{ServiceName: "test"}},
+		Middleware:      []config.Middleware{{Name: "ip_table", Open: true}},
+	})
+}
+
+func newTestGatewayWithConfig(upstream *httptest.Server, testConfig config.Client) (*Gateway, error) {
+	discover := &memoryDiscover{serviceMap: map[string]etcd.ServiceMapStruct{
+		"test": {ServiceUrlSlice: []config.ServiceUrlStruct{{Url: strings.TrimPrefix(upstream.URL, "http://"), Weight: 1}}},
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return New(testConfig, WithServiceDiscover(discover), WithListener(listener))
+}
+
+func get(gateway *Gateway) (int, string) {
+	resp, err := http.Get("http://" + gateway.Addr().String() + "/test/get")
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestGateway(t *testing.T) {
+	Convey("two gateways in one process", t, func() {
+		firstUpstream, secondUpstream := newUpstream("first"), newUpstream("second")
+		defer firstUpstream.Close()
+		defer secondUpstream.Close()
+		first, err := newTestGateway(firstUpstream, nil)
+		So(err, ShouldBeNil)
+		second, err := newTestGateway(secondUpstream, []string{"127.0.0.1"})
+		So(err, ShouldBeNil)
+		So(first.Start(), ShouldBeNil)
+		So(second.Start(), ShouldBeNil)
+		So(first.Start(), ShouldEqual, AlreadyStartedErr)
+
+		code, body := get(first)
+		So(code, ShouldEqual, http.StatusOK)
+		So(body, ShouldEqual, "first")
+		code, _ = get(second)
+		So(code, ShouldEqual, http.StatusForbidden)
+		So(first.Proxy().GetStatistics("test").RequestCount, ShouldEqual, 1)
+		So(second.Proxy().GetStatistics("test").RequestCount, ShouldEqual, 0)
+
+		So(second.Shutdown(context.Background()), ShouldBeNil)
+		code, body = get(first)
+		So(code, ShouldEqual, http.StatusOK)
+		So(body, ShouldEqual, "first")
+		So(first.Shutdown(context.Background()), ShouldBeNil)
+		code, _ = get(first)
+		So(code, ShouldEqual, 0)
+	})
+	Convey("round robin index owned by each gateway", t, func() {
+		firstUpstream, secondUpstream := newUpstream("first"), newUpstream("second")
+		defer firstUpstream.Close()
+		defer secondUpstream.Close()
+		newRoundRobin := func() *Gateway {
+			discover := &memoryDiscover{serviceMap: map[string]etcd.ServiceMapStruct{
+				"test": {ServiceUrlSlice: []config.ServiceUrlStruct{
+					{Url: strings.TrimPrefix(firstUpstream.URL, "http://"), Weight: 1},
+					{Url: strings.TrimPrefix(secondUpstream.URL, "http://"), Weight: 1},
+				}},
+			}}
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			gateway, err := New(config.Client{
+				LoadBalanceMode: config.LoadBalanceModeRoundRobin,
+				ReverseHost:     []config.ReverseHost{{ServiceName: "test"}},
+			}, WithServiceDiscover(discover), WithListener(listener))
+			So(err, ShouldBeNil)
+			return gateway
+		}
+		serve := func(gateway *Gateway) string {
+			w := httptest.NewRecorder()
+			gateway.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/test/get", nil))
+			return w.Body.String()
+		}
+		first, second := newRoundRobin(), newRoundRobin()
+		defer first.Shutdown(context.Background())
+		defer second.Shutdown(context.Background())
+		firstBody := serve(first)
+		So(serve(first), ShouldNotEqual, firstBody)
+		So(serve(first), ShouldEqual, firstBody)
+		So(serve(second), ShouldEqual, firstBody)
+		So(serve(second), ShouldNotEqual, firstBody)
+	})
+}
+
+func TestGatewayAdmin(t *testing.T) {
+	Convey("admin requires token", t, func() {
+		upstream := newUpstream("ok")
+		defer upstream.Close()
+		testConfig := config.Client{
+			LoadBalanceMode: config.LoadBalanceModeRandom,
+			ReverseHost:     []config.ReverseHost{{ServiceName: "test"}},
+			Admin:           config.Admin{Open: true},
+		}
+		_, err := newTestGatewayWithConfig(upstream, testConfig)
+		So(err, ShouldEqual, admin.TokenRequiredErr)
+		testConfig.Admin.Token = "secret"
+		gateway, err := newTestGatewayWithConfig(upstream, testConfig)
+		So(err, ShouldBeNil)
+		defer gateway.Shutdown(context.Background())
+		serveAdmin := func(token string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/go/admin/split?route=test", nil)
+			if token != "" {
+				req.Header.Set("Admin-Token", token)
+			}
+			gateway.Handler().ServeHTTP(w, req)
+			return w.Code
+		}
+		So(serveAdmin(""), ShouldEqual, http.StatusForbidden)
+		So(serveAdmin("wrong"), ShouldEqual, http.StatusForbidden)
+		So(serveAdmin("secret"), ShouldEqual, http.StatusOK)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/go/admin/metrics", nil)
+		req.Header.Set("Admin-Token", "secret")
+		gateway.Handler().ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+// memorySink 记录写入的事件，测试时替代es
+type memorySink struct {
+	mu         sync.Mutex
+	eventSlice []collector.Event
+}
+
+func (sink *memorySink) Init(collectorConfig config.Collector, params map[string]interface{}) error {
+	return nil
+}
+
+func (sink *memorySink) WriteBatch(ctx context.Context, eventSlice []collector.Event) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.eventSlice = append(sink.eventSlice, eventSlice...)
+	return nil
+}
+
+func (sink *memorySink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	return nil
+}
+
+func (sink *memorySink) metric(name string) (collector.MetricMsg, bool) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for _, event := range sink.eventSlice {
+		if metric, ok := event.Data.(collector.MetricMsg); ok && event.Type == collector.MetricEvent && metric.Name == name {
+			return metric, true
+		}
+	}
+	return collector.MetricMsg{}, false
+}
+
+func TestGatewayMetric(t *testing.T) {
+	sink := &memorySink{}
+	collector.RegisterSink("gateway_test", func() collector.Sink {
+		return sink
+	})
+	Convey("middleware gauges written to collector", t, func() {
+		upstream := newUpstream("ok")
+		defer upstream.Close()
+		gateway, err := newTestGatewayWithConfig(upstream, config.Client{
+			LoadBalanceMode: config.LoadBalanceModeRandom,
+			ReverseHost:     []config.ReverseHost{{ServiceName: "test"}},
+			Middleware:      []config.Middleware{{Name: "restrictor", Open: true}},
+			Restrictor:      config.Restrictor{Open: true, Rate: 10, MaxToken: 10},
+			OpenCollector:   true,
+			Collector:       config.Collector{Switch: "gateway_test", BatchSize: 1, FlushInterval: 1, MetricInterval: 1},
+		})
+		So(err, ShouldBeNil)
+		So(gateway.Proxy().Gauges(), ShouldContainKey, "restrictor_queue_depth.default")
+		So(gateway.Start(), ShouldBeNil)
+		var found bool
+		for i := 0; i < 30 && !found; i++ {
+			time.Sleep(100 * time.Millisecond)
+			_, found = sink.metric("restrictor_queue_depth.default")
+		}
+		So(gateway.Shutdown(context.Background()), ShouldBeNil)
+		So(found, ShouldBeTrue)
+	})
+}
+
+// newTestCertificate 签发测试证书，parent为nil时自签名
+func newTestCertificate(commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	certificate, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return certificate, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestGatewayTls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPem, _ := newTestCertificate("test ca", nil, nil)
+	_, _, serverPem, serverKeyPem := newTestCertificate("gateway", ca, caKey)
+	_, _, clientPem, clientKeyPem := newTestCertificate("client", ca, caKey)
+	_ = ioutil.WriteFile(filepath.Join(dir, "ca.pem"), caPem, 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "server.pem"), serverPem, 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "server.key"), serverKeyPem, 0600)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca)
+	clientCertificate, _ := tls.X509KeyPair(clientPem, clientKeyPem)
+
+	Convey("tls listener with client certificates", t, func() {
+		upstream := newUpstream("tls")
+		defer upstream.Close()
+		tlsConfig := config.Tls{
+			Open:          true,
+			CertFile:      filepath.Join(dir, "server.pem"),
+			KeyFile:       filepath.Join(dir, "server.key"),
+			ClientCaFiles: []string{filepath.Join(dir, "ca.pem")},
+			ClientAuth:    config.ClientAuthRequire,
+		}
+		gateway, err := newTestGatewayWithConfig(upstream, config.Client{
+			LoadBalanceMode: config.LoadBalanceModeRandom,
+			ReverseHost:     []config.ReverseHost{{ServiceName: "test"}},
+			Middleware:      []config.Middleware{{Name: "ip_table", Open: true}},
+			Tls:             tlsConfig,
+		})
+		So(err, ShouldBeNil)
+		So(gateway.Start(), ShouldBeNil)
+		defer gateway.Shutdown(context.Background())
+
+		target := "https://" + gateway.Addr().String() + "/test/get"
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{clientCertificate},
+		}}}
+		resp, err := client.Get(target)
+		So(err, ShouldBeNil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(string(body), ShouldEqual, "tls")
+
+		anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+		_, err = anonymous.Get(target)
+		So(err, ShouldNotBeNil)
+
+		tlsConfig.ClientCaFiles = []string{filepath.Join(dir, "server.key")}
+		_, err = New(config.Client{Tls: tlsConfig}, WithServiceDiscover(&memoryDiscover{}))
+		So(errors.Is(err, ClientCaErr), ShouldBeTrue)
+	})
+}
@@ -4,17 +4,15 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"net/http/httptest"
 	"reflect"
-	"simple_proxygateway/collector"
 	"strings"
 	"testing"
 	"time"
 
 	"simple_proxygateway/config"
 	"simple_proxygateway/etcd"
-	"simple_proxygateway/transmit"
+	"simple_proxygateway/gateway"
 
 	jsoniter "github.com/json-iterator/go"
 	. "github.com/smartystreets/goconvey/convey"
@@ -30,7 +28,6 @@ func TestMain(m *testing.M) {
 	var err error
 	proxyConfig = &config.Client{}
 	config.LoadConf(proxyConfig, "config.yaml")
-	collector.NewCollector(*proxyConfig)
 	etcdHandler, err = clientv3.New(clientv3.Config{
 		Endpoints:   []string{"127.0.0.1:2379"},
 		DialTimeout: 5 * time.Second,
@@ -42,7 +39,11 @@ func TestMain(m *testing.M) {
 }
 
 func TestEtcd(t *testing.T) {
-	ServiceDiscover := etcd.NewEtcd(*proxyConfig)
+	ServiceDiscover, err := etcd.NewEtcd(*proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ServiceDiscover.Exit()
 	Convey("add etcd data", t, func() {
 		respL, err := etcdHandler.Grant(context.TODO(), 30)
 		if err != nil {
@@ -118,9 +119,16 @@ func TestEtcd(t *testing.T) {
 }
 
 func TestTransmit(t *testing.T) {
-	ServiceDiscover := etcd.NewEtcd(*proxyConfig)
-	proxy := transmit.NewProxyHandler(ServiceDiscover, proxyConfig.LoadBalanceMode, *proxyConfig)
-	initRouter(proxy)
+	ServiceDiscover, err := etcd.NewEtcd(*proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ServiceDiscover.Exit()
+	gatewayHandler, err := gateway.New(*proxyConfig, gateway.WithServiceDiscover(ServiceDiscover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gatewayHandler.Shutdown(context.Background())
 	Convey("add es data", t, func() {
 		respL, err := etcdHandler.Grant(context.TODO(), 30)
 		if err != nil {
@@ -161,7 +169,7 @@ func TestTransmit(t *testing.T) {
 			testName: "transmit test",
 			method:   "POST",
 			target:   "/test/st?key=1&key1=2",
-			code:     404,
+			code:     502,
 		},
 	}
 	for _, testsRow := range testsStruct {
@@ -169,7 +177,7 @@ func TestTransmit(t *testing.T) {
 			w := httptest.NewRecorder()
 			req := httptest.NewRequest(testsRow.method, testsRow.target, strings.NewReader(""))
 			req.Header.Set("Content-type", "application/x-www-form-urlencoded")
-			http.DefaultServeMux.ServeHTTP(w, req)
+			gatewayHandler.Handler().ServeHTTP(w, req)
 			result := make(map[string]interface{}, 0)
 			err := jsoniter.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
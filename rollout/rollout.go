@@ -0,0 +1,279 @@
+package rollout
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"simple_proxygateway/collector"
+	"simple_proxygateway/config"
+	"simple_proxygateway/etcd"
+	"simple_proxygateway/logger"
+	"simple_proxygateway/transmit"
+)
+
+const (
+	ActionAdvance  = "advance"
+	ActionHold     = "hold"
+	ActionRollback = "rollback"
+	ActionComplete = "complete"
+)
+
+type (
+	// StatisticsGetter 转发统计来源，由 transmit.Proxy 实现
+	StatisticsGetter interface {
+		GetStatistics(serviceName string) transmit.ServiceStatistics
+	}
+	// StateStore 发布进度持久化及主实例选举，由 etcd.LocalCache 实现
+	StateStore interface {
+		GetRolloutState(routeName string) (etcd.RolloutState, bool, error)
+		PutRolloutState(routeName string, state etcd.RolloutState) error
+		CampaignRollout(routeName string, ttl int64) (bool, error)
+		ResignRollout(routeName string)
+	}
+	// Controller 按步骤逐步提升canary流量，指标超出阈值时自动回滚
+	// 多实例部署时各路由由抢占到控制权的实例推进，统计数据来源于该实例，仅为集群流量的一部分，
+	// 因此canary与baseline均需累计 min_requests 个请求后才判断，不足时保持当前步骤继续累计；发布进度写入etcd，重启或切换主实例后继续
+	Controller struct {
+		serviceDiscover  etcd.ServiceDiscover
+		stateStore       StateStore //服务发现未实现时按单实例处理，进度不持久化
+		statisticsGetter StatisticsGetter
+		collector        *collector.Collector
+		stop             chan struct{}
+		wg               sync.WaitGroup
+	}
+)
+
+var (
+	defaultLeaderTtl         = 15
+	defaultMinRequests int64 = 100
+)
+
+// NewController eventCollector 为nil时不记录发布过程
+func NewController(serviceDiscover etcd.ServiceDiscover, statisticsGetter StatisticsGetter, eventCollector *collector.Collector, proxyConfig config.Client) *Controller {
+	controller := &Controller{
+		serviceDiscover:  serviceDiscover,
+		statisticsGetter: statisticsGetter,
+		collector:        eventCollector,
+		stop:             make(chan struct{}),
+	}
+	controller.stateStore, _ = serviceDiscover.(StateStore)
+	for _, rollout := range proxyConfig.Rollout {
+		if len(rollout.Steps) == 0 || rollout.StepInterval <= 0 {
+			logger.Runtime.Error(fmt.Sprintf("rollout config invalid, route:%s", rollout.Route))
+			continue
+		}
+		controller.wg.Add(1)
+		go func(rollout config.Rollout) {
+			defer controller.wg.Done()
+			controller.run(rollout)
+		}(rollout)
+	}
+	return controller
+}
+
+func (controller *Controller) Stop() {
+	close(controller.stop)
+	controller.wg.Wait()
+	fmt.Println("rollout stop")
+}
+
+// run 抢占控制权后推进发布，控制权丢失时重新等待抢占
+func (controller *Controller) run(rollout config.Rollout) {
+	if controller.stateStore != nil {
+		defer controller.stateStore.ResignRollout(rollout.Route)
+	}
+	campaignTicker := time.NewTicker(time.Duration(defaultLeaderTtl) * time.Second / 3)
+	defer campaignTicker.Stop()
+	for {
+		if controller.campaign(rollout) && controller.lead(rollout, campaignTicker.C) {
+			return
+		}
+		select {
+		case <-campaignTicker.C:
+		case <-controller.stop:
+			return
+		}
+	}
+}
+
+// campaign 返回当前实例是否持有路由的发布控制权
+func (controller *Controller) campaign(rollout config.Rollout) bool {
+	if controller.stateStore == nil {
+		return true
+	}
+	leader, err := controller.stateStore.CampaignRollout(rollout.Route, int64(defaultLeaderTtl))
+	if err != nil {
+		logger.Runtime.Error(fmt.Sprintf("rollout campaign err, route:%s, err:%s", rollout.Route, err.Error()))
+		return false
+	}
+	return leader
+}
+
+// loadState 读取发布进度，canary服务或步骤配置变更后从第一步开始
+func (controller *Controller) loadState(rollout config.Rollout) (etcd.RolloutState, bool) {
+	fresh := etcd.RolloutState{CanaryService: rollout.CanaryService, Steps: rollout.Steps}
+	if controller.stateStore == nil {
+		return fresh, true
+	}
+	state, ok, err := controller.stateStore.GetRolloutState(rollout.Route)
+	if err != nil {
+		logger.Runtime.Error(fmt.Sprintf("rollout get state err, route:%s, err:%s", rollout.Route, err.Error()))
+		return state, false
+	}
+	if !ok || state.CanaryService != rollout.CanaryService || !sameSteps(state.Steps, rollout.Steps) || state.StepIndex >= len(rollout.Steps) {
+		return fresh, true
+	}
+	return state, true
+}
+
+func (controller *Controller) saveState(rollout config.Rollout, state etcd.RolloutState) bool {
+	if controller.stateStore == nil {
+		return true
+	}
+	if err := controller.stateStore.PutRolloutState(rollout.Route, state); err != nil {
+		logger.Runtime.Error(fmt.Sprintf("rollout put state err, route:%s, err:%s", rollout.Route, err.Error()))
+		return false
+	}
+	return true
+}
+
+// lead 从已保存的进度推进发布，返回false时表示控制权丢失或进度读写失败，需重新抢占
+func (controller *Controller) lead(rollout config.Rollout, campaignC <-chan time.Time) bool {
+	state, ok := controller.loadState(rollout)
+	if !ok {
+		return false
+	}
+	if state.Action == ActionComplete || state.Action == ActionRollback {
+		logger.Runtime.Info(fmt.Sprintf("rollout route:%s, canary:%s already finished, action:%s", rollout.Route, rollout.CanaryService, state.Action))
+		return true
+	}
+	if !controller.setCanaryWeight(rollout, rollout.Steps[state.StepIndex]) {
+		return false
+	}
+	if state.Action == "" {
+		state.Action = ActionAdvance
+		if !controller.saveState(rollout, state) {
+			return false
+		}
+		controller.record(rollout, rollout.Steps[state.StepIndex], ActionAdvance, transmit.ServiceStatistics{}, transmit.ServiceStatistics{})
+	}
+	holdCount := 0
+	baselineBefore, canaryBefore := controller.statisticsGetter.GetStatistics(rollout.BaselineService), controller.statisticsGetter.GetStatistics(rollout.CanaryService)
+	//canary全量后baseline无流量，沿用最近一次有效的baseline数据对比
+	var lastBaseline transmit.ServiceStatistics
+	ticker := time.NewTicker(time.Duration(rollout.StepInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			baselineNow, canaryNow := controller.statisticsGetter.GetStatistics(rollout.BaselineService), controller.statisticsGetter.GetStatistics(rollout.CanaryService)
+			baseline, canary := baselineNow.Sub(baselineBefore), canaryNow.Sub(canaryBefore)
+			if baseline.RequestCount >= minRequests(rollout) {
+				lastBaseline = baseline
+			}
+			action := judge(rollout, lastBaseline, canary)
+			if action == ActionHold {
+				holdCount++
+				if rollout.MaxHoldSteps > 0 && holdCount >= rollout.MaxHoldSteps {
+					action = ActionRollback
+				}
+			}
+			switch action {
+			case ActionHold:
+				controller.record(rollout, rollout.Steps[state.StepIndex], ActionHold, lastBaseline, canary)
+				continue
+			case ActionRollback:
+				controller.setCanaryWeight(rollout, 0)
+				state.Action = ActionRollback
+				controller.saveState(rollout, state)
+				controller.record(rollout, 0, ActionRollback, lastBaseline, canary)
+				return true
+			}
+			holdCount = 0
+			if state.StepIndex+1 >= len(rollout.Steps) {
+				state.Action = ActionComplete
+				controller.saveState(rollout, state)
+				controller.record(rollout, rollout.Steps[state.StepIndex], ActionComplete, lastBaseline, canary)
+				return true
+			}
+			if !controller.setCanaryWeight(rollout, rollout.Steps[state.StepIndex+1]) {
+				return false
+			}
+			state.StepIndex++
+			if !controller.saveState(rollout, state) {
+				return false
+			}
+			controller.record(rollout, rollout.Steps[state.StepIndex], ActionAdvance, lastBaseline, canary)
+			baselineBefore, canaryBefore = baselineNow, canaryNow
+		case <-campaignC:
+			if !controller.campaign(rollout) {
+				logger.Runtime.Error(fmt.Sprintf("rollout leader lost, route:%s", rollout.Route))
+				return false
+			}
+		case <-controller.stop:
+			return true
+		}
+	}
+}
+
+func minRequests(rollout config.Rollout) int64 {
+	if rollout.MinRequests > 0 {
+		return rollout.MinRequests
+	}
+	return defaultMinRequests
+}
+
+func sameSteps(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// judge 比较当前步骤内canary与baseline的错误率及平均耗时，任一方样本不足时保持
+func judge(rollout config.Rollout, baseline transmit.ServiceStatistics, canary transmit.ServiceStatistics) string {
+	if canary.RequestCount < minRequests(rollout) || baseline.RequestCount < minRequests(rollout) {
+		return ActionHold
+	}
+	if canary.ErrorRate() > baseline.ErrorRate()+rollout.MaxErrorRateDiff {
+		return ActionRollback
+	}
+	if rollout.MaxLatencyRatio > 0 && baseline.RequestCount > 0 && canary.AvgLatency() > baseline.AvgLatency()*rollout.MaxLatencyRatio {
+		return ActionRollback
+	}
+	return ActionAdvance
+}
+
+func (controller *Controller) setCanaryWeight(rollout config.Rollout, percent int) bool {
+	splitSlice := []config.SplitStruct{
+		{ServiceName: rollout.BaselineService, Weight: 100 - percent},
+		{ServiceName: rollout.CanaryService, Weight: percent},
+	}
+	if err := controller.serviceDiscover.PutSplit(rollout.Route, splitSlice); err != nil {
+		logger.Runtime.Error(fmt.Sprintf("rollout put split err, route:%s, err:%s", rollout.Route, err.Error()))
+		return false
+	}
+	return true
+}
+
+func (controller *Controller) record(rollout config.Rollout, percent int, action string, baseline transmit.ServiceStatistics, canary transmit.ServiceStatistics) {
+	logger.Runtime.Info(fmt.Sprintf("rollout route:%s, canary:%s, step:%d, action:%s", rollout.Route, rollout.CanaryService, percent, action))
+	go controller.collector.WriteRollout(collector.RolloutMsg{
+		Route:             rollout.Route,
+		BaselineService:   rollout.BaselineService,
+		CanaryService:     rollout.CanaryService,
+		Step:              percent,
+		Action:            action,
+		BaselineErrorRate: baseline.ErrorRate(),
+		CanaryErrorRate:   canary.ErrorRate(),
+		BaselineLatency:   baseline.AvgLatency(),
+		CanaryLatency:     canary.AvgLatency(),
+		RecordTime:        int(time.Now().Unix()),
+	})
+}
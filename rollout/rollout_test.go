@@ -0,0 +1,162 @@
+package rollout
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/etcd"
+	"simple_proxygateway/transmit"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJudge(t *testing.T) {
+	Convey("judge canary step", t, func() {
+		rollout := config.Rollout{
+			MinRequests:      10,
+			MaxErrorRateDiff: 0.05,
+			MaxLatencyRatio:  1.5,
+		}
+		baseline := transmit.ServiceStatistics{RequestCount: 100, ErrorCount: 1, LatencyTotal: 1000}
+		Convey("not enough canary requests", func() {
+			canary := transmit.ServiceStatistics{RequestCount: 5}
+			So(judge(rollout, baseline, canary), ShouldEqual, ActionHold)
+		})
+		Convey("not enough baseline requests", func() {
+			canary := transmit.ServiceStatistics{RequestCount: 20, ErrorCount: 10, LatencyTotal: 200}
+			So(judge(rollout, transmit.ServiceStatistics{RequestCount: 5}, canary), ShouldEqual, ActionHold)
+			So(judge(rollout, transmit.ServiceStatistics{}, canary), ShouldEqual, ActionHold)
+		})
+		Convey("default min requests on small samples", func() {
+			rollout.MinRequests = 0
+			//单个实例只看到部分流量，少量错误不应直接回滚
+			canary := transmit.ServiceStatistics{RequestCount: 2, ErrorCount: 1, LatencyTotal: 20}
+			So(judge(rollout, baseline, canary), ShouldEqual, ActionHold)
+			canary = transmit.ServiceStatistics{RequestCount: defaultMinRequests, ErrorCount: 50, LatencyTotal: 1000}
+			So(judge(rollout, baseline, canary), ShouldEqual, ActionRollback)
+		})
+		Convey("canary healthy", func() {
+			canary := transmit.ServiceStatistics{RequestCount: 20, ErrorCount: 1, LatencyTotal: 240}
+			So(judge(rollout, baseline, canary), ShouldEqual, ActionAdvance)
+		})
+		Convey("canary error rate breached", func() {
+			canary := transmit.ServiceStatistics{RequestCount: 20, ErrorCount: 3, LatencyTotal: 200}
+			So(judge(rollout, baseline, canary), ShouldEqual, ActionRollback)
+		})
+		Convey("canary latency breached", func() {
+			canary := transmit.ServiceStatistics{RequestCount: 20, LatencyTotal: 400}
+			So(judge(rollout, baseline, canary), ShouldEqual, ActionRollback)
+		})
+	})
+}
+
+// memoryStore 内存实现的服务发现及发布进度，leader为false时模拟其他实例持有控制权
+type memoryStore struct {
+	mu         sync.Mutex
+	leader     bool
+	state      map[string]etcd.RolloutState
+	splitSlice []config.SplitStruct
+}
+
+func (store *memoryStore) Get(serviceName string) (etcd.ServiceMapStruct, error) {
+	return etcd.ServiceMapStruct{}, etcd.ServiceNotFoundErr
+}
+
+func (store *memoryStore) Exit() {}
+
+func (store *memoryStore) Delete(serviceName string) {}
+
+func (store *memoryStore) GetSplit(routeName string) []config.SplitStruct {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.splitSlice
+}
+
+func (store *memoryStore) PutSplit(routeName string, splitSlice []config.SplitStruct) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.splitSlice = splitSlice
+	return nil
+}
+
+func (store *memoryStore) SetDraining(serviceName string, url string, draining bool) error {
+	return nil
+}
+
+func (store *memoryStore) GetRolloutState(routeName string) (etcd.RolloutState, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state, ok := store.state[routeName]
+	return state, ok, nil
+}
+
+func (store *memoryStore) PutRolloutState(routeName string, state etcd.RolloutState) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.state[routeName] = state
+	return nil
+}
+
+func (store *memoryStore) CampaignRollout(routeName string, ttl int64) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.leader, nil
+}
+
+func (store *memoryStore) ResignRollout(routeName string) {}
+
+type emptyStatistics struct{}
+
+func (emptyStatistics) GetStatistics(serviceName string) transmit.ServiceStatistics {
+	return transmit.ServiceStatistics{}
+}
+
+func TestControllerState(t *testing.T) {
+	Convey("rollout state persisted and resumed", t, func() {
+		rollout := config.Rollout{Route: "test", BaselineService: "v1", CanaryService: "v2", Steps: []int{5, 25, 100}, StepInterval: 60}
+		proxyConfig := config.Client{Rollout: []config.Rollout{rollout}}
+		start := func(store *memoryStore) {
+			controller := NewController(store, emptyStatistics{}, nil, proxyConfig)
+			time.Sleep(50 * time.Millisecond)
+			controller.Stop()
+		}
+		Convey("fresh rollout starts at first step", func() {
+			store := &memoryStore{leader: true, state: map[string]etcd.RolloutState{}}
+			start(store)
+			So(store.GetSplit("test")[1].Weight, ShouldEqual, 5)
+			So(store.state["test"].StepIndex, ShouldEqual, 0)
+			So(store.state["test"].Action, ShouldEqual, ActionAdvance)
+		})
+		Convey("restart resumes saved step", func() {
+			store := &memoryStore{leader: true, state: map[string]etcd.RolloutState{
+				"test": {CanaryService: "v2", Steps: []int{5, 25, 100}, StepIndex: 1, Action: ActionAdvance},
+			}}
+			start(store)
+			So(store.GetSplit("test")[1].Weight, ShouldEqual, 25)
+			So(store.state["test"].StepIndex, ShouldEqual, 1)
+		})
+		Convey("finished rollout not restarted", func() {
+			store := &memoryStore{leader: true, state: map[string]etcd.RolloutState{
+				"test": {CanaryService: "v2", Steps: []int{5, 25, 100}, StepIndex: 2, Action: ActionRollback},
+			}}
+			start(store)
+			So(store.GetSplit("test"), ShouldBeNil)
+		})
+		Convey("changed steps restart rollout", func() {
+			store := &memoryStore{leader: true, state: map[string]etcd.RolloutState{
+				"test": {CanaryService: "v2", Steps: []int{10, 100}, StepIndex: 1, Action: ActionComplete},
+			}}
+			start(store)
+			So(store.GetSplit("test")[1].Weight, ShouldEqual, 5)
+			So(store.state["test"].Steps, ShouldResemble, []int{5, 25, 100})
+		})
+		Convey("non leader does not touch split", func() {
+			store := &memoryStore{state: map[string]etcd.RolloutState{}}
+			start(store)
+			So(store.GetSplit("test"), ShouldBeNil)
+			So(store.state, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,122 @@
+package transmit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+)
+
+const defaultAffinityCookieName = "gateway_affinity"
+
+// affinity 会话保持配置及cookie签名密钥
+type affinity struct {
+	config config.SessionAffinity
+	secret []byte
+}
+
+func newAffinity(sessionAffinity config.SessionAffinity) *affinity {
+	a := &affinity{config: sessionAffinity}
+	if a.config.CookieName == "" {
+		a.config.CookieName = defaultAffinityCookieName
+	}
+	if a.config.Secret != "" {
+		a.secret = []byte(a.config.Secret)
+		return a
+	}
+	//未配置密钥时随机生成，多实例部署时各实例签发的cookie互不认可
+	a.secret = make([]byte, 32)
+	_, _ = rand.Read(a.secret)
+	if a.config.Open {
+		logger.Runtime.Warn("session affinity secret not set, cookies will not be shared between gateways")
+	}
+	return a
+}
+
+// getTransmitHostByCookie 校验会话cookie，节点已移除、不健康或不在子集内时返回空重新分配
+func (p *Proxy) getTransmitHostByCookie(req *http.Request, serviceName string, subset map[string]string) string {
+	cookie, err := req.Cookie(p.affinity.cookieName(serviceName))
+	if err != nil {
+		return ""
+	}
+	now := time.Now()
+	host, ok := p.affinity.parseValue(cookie.Value, serviceName, now)
+	if !ok {
+		return ""
+	}
+	serviceMapStruct, err := p.serviceDiscover.Get(serviceName)
+	if err != nil || !isBoundHostAvailable(host, serviceMapStruct, now, p.drainTimeout) || !p.isEndpointHealthy(host) {
+		return ""
+	}
+	//绑定的节点须仍属于当前选中的优先级及区域，主节点恢复后不再停留在备用或跨区域节点；下线中的绑定节点在drain_timeout内同样参与筛选
+	urlSlice := filterDraining(serviceMapStruct.ServiceUrlSlice)
+	for _, urlStruct := range serviceMapStruct.ServiceUrlSlice {
+		if urlStruct.Url == host && urlStruct.Draining {
+			urlSlice = append(urlSlice, urlStruct)
+		}
+	}
+	for _, urlStruct := range p.selectEndpoints(urlSlice, subset) {
+		if urlStruct.Url == host {
+			return host
+		}
+	}
+	return ""
+}
+
+func (a *affinity) newCookie(serviceName string, host string, now time.Time) *http.Cookie {
+	ttl := time.Duration(a.config.Ttl) * time.Second
+	return &http.Cookie{
+		Name:     a.cookieName(serviceName),
+		Value:    a.signValue(serviceName, host, now.Add(ttl).Unix()),
+		Path:     "/",
+		MaxAge:   a.config.Ttl,
+		HttpOnly: true,
+	}
+}
+
+func (a *affinity) cookieName(serviceName string) string {
+	return a.config.CookieName + "_" + serviceName
+}
+
+// signValue cookie格式为 base64(服务|节点|过期时间).base64(签名)
+func (a *affinity) signValue(serviceName string, host string, expire int64) string {
+	payload := serviceName + "|" + host + "|" + strconv.FormatInt(expire, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(a.sign(payload))
+}
+
+func (a *affinity) parseValue(value string, serviceName string, now time.Time) (string, bool) {
+	pieceSlice := strings.Split(value, ".")
+	if len(pieceSlice) != 2 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(pieceSlice[0])
+	if err != nil {
+		return "", false
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(pieceSlice[1])
+	if err != nil || !hmac.Equal(sign, a.sign(string(payload))) {
+		return "", false
+	}
+	fieldSlice := strings.Split(string(payload), "|")
+	if len(fieldSlice) != 3 || fieldSlice[0] != serviceName {
+		return "", false
+	}
+	expire, err := strconv.ParseInt(fieldSlice[2], 10, 64)
+	if err != nil || now.Unix() >= expire {
+		return "", false
+	}
+	return fieldSlice[1], true
+}
+
+func (a *affinity) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
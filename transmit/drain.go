@@ -0,0 +1,34 @@
+package transmit
+
+import (
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/etcd"
+)
+
+// filterDraining 下线中的节点不再分配新的请求
+func filterDraining(urlSlice []config.ServiceUrlStruct) []config.ServiceUrlStruct {
+	activeSlice := make([]config.ServiceUrlStruct, 0, len(urlSlice))
+	for _, urlStruct := range urlSlice {
+		if !urlStruct.Draining {
+			activeSlice = append(activeSlice, urlStruct)
+		}
+	}
+	return activeSlice
+}
+
+// isBoundHostAvailable 已绑定的节点被移除，或下线超过drainTimeout后需重新分配
+func isBoundHostAvailable(host string, serviceMapStruct etcd.ServiceMapStruct, now time.Time, drainTimeout time.Duration) bool {
+	for _, urlStruct := range serviceMapStruct.ServiceUrlSlice {
+		if urlStruct.Url != host {
+			continue
+		}
+		if !urlStruct.Draining {
+			return true
+		}
+		drainTime, ok := serviceMapStruct.DrainTimeMap[host]
+		return ok && now.Sub(drainTime) < drainTimeout
+	}
+	return false
+}
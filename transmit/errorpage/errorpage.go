@@ -0,0 +1,158 @@
+package errorpage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	htmlTemplate "html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	textTemplate "text/template"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// RequestIdHeader 请求id，客户端未携带时由网关生成并透传至上游
+const RequestIdHeader = "X-Request-Id"
+
+type (
+	// Page 错误页模板可用字段
+	Page struct {
+		Code       int
+		Msg        string
+		RequestId  string
+		Service    string
+		Path       string
+		RetryAfter int
+	}
+	executor interface {
+		Execute(buf *bytes.Buffer, page Page) error
+	}
+	pageTemplate struct {
+		contentType string
+		executor    executor
+	}
+	textExecutor struct {
+		tpl *textTemplate.Template
+	}
+	htmlExecutor struct {
+		tpl *htmlTemplate.Template
+	}
+	defaultBody struct {
+		Msg       string
+		Data      interface{}
+		Code      int
+		RequestId string `json:",omitempty"`
+	}
+)
+
+// Pages 各路由的错误页模板，由网关实例持有
+type Pages struct {
+	templateMap map[string]pageTemplate
+}
+
+type pagesKey struct{}
+
+// 未设置错误页时使用默认json格式
+var defaultPages = &Pages{}
+
+// New 编译各路由的错误页模板，模板错误时该路由使用默认json格式
+func New(proxyConfig config.Client) *Pages {
+	pages := &Pages{templateMap: make(map[string]pageTemplate)}
+	for _, host := range proxyConfig.ReverseHost {
+		if host.ErrorPage.Template == "" {
+			continue
+		}
+		contentType := host.ErrorPage.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		var tplExecutor executor
+		var err error
+		if strings.Contains(contentType, "html") {
+			var tpl *htmlTemplate.Template
+			tpl, err = htmlTemplate.New(host.ServiceName).Parse(host.ErrorPage.Template)
+			tplExecutor = htmlExecutor{tpl: tpl}
+		} else {
+			var tpl *textTemplate.Template
+			tpl, err = textTemplate.New(host.ServiceName).Funcs(textFuncMap(contentType)).Parse(host.ErrorPage.Template)
+			tplExecutor = textExecutor{tpl: tpl}
+		}
+		if err != nil {
+			logger.Runtime.Error("error page template err:" + err.Error())
+			continue
+		}
+		pages.templateMap[host.ServiceName] = pageTemplate{contentType: contentType, executor: tplExecutor}
+	}
+	return pages
+}
+
+// NewContext 将错误页写入请求上下文，供中间件中断请求时使用
+func NewContext(ctx context.Context, pages *Pages) context.Context {
+	return context.WithValue(ctx, pagesKey{}, pages)
+}
+
+// FromContext 获取请求上下文中的错误页，不存在时使用默认json格式
+func FromContext(ctx context.Context) *Pages {
+	if pages, ok := ctx.Value(pagesKey{}).(*Pages); ok && pages != nil {
+		return pages
+	}
+	return defaultPages
+}
+
+// Write 按路由模板输出错误响应
+func (pages *Pages) Write(w http.ResponseWriter, routeName string, page Page) {
+	if page.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(page.RetryAfter))
+	}
+	if page.RequestId != "" {
+		w.Header().Set(RequestIdHeader, page.RequestId)
+	}
+	if tpl, ok := pages.templateMap[routeName]; ok {
+		var buf bytes.Buffer
+		err := tpl.executor.Execute(&buf, page)
+		if err == nil {
+			w.Header().Set("Content-Type", tpl.contentType)
+			w.WriteHeader(page.Code)
+			_, _ = w.Write(buf.Bytes())
+			return
+		}
+		logger.Runtime.Error("error page execute err:" + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(page.Code)
+	errJson, _ := jsoniter.Marshal(defaultBody{Msg: "error!" + page.Msg, Data: "", Code: page.Code, RequestId: page.RequestId})
+	_, _ = w.Write(errJson)
+}
+
+// NewRequestId 生成随机请求id
+func NewRequestId() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// textFuncMap json格式模板提供 json 函数，{{json .Msg}} 输出带引号且已转义的字符串
+func textFuncMap(contentType string) textTemplate.FuncMap {
+	funcMap := textTemplate.FuncMap{}
+	if strings.Contains(contentType, "json") {
+		funcMap["json"] = func(value interface{}) (string, error) {
+			jsonStr, err := jsoniter.Marshal(value)
+			return string(jsonStr), err
+		}
+	}
+	return funcMap
+}
+
+func (executor textExecutor) Execute(buf *bytes.Buffer, page Page) error {
+	return executor.tpl.Execute(buf, page)
+}
+
+func (executor htmlExecutor) Execute(buf *bytes.Buffer, page Page) error {
+	return executor.tpl.Execute(buf, page)
+}
@@ -0,0 +1,70 @@
+package errorpage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"simple_proxygateway/config"
+
+	jsoniter "github.com/json-iterator/go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWrite(t *testing.T) {
+	Convey("write error page", t, func() {
+		pages := New(config.Client{ReverseHost: []config.ReverseHost{
+			{
+				ServiceName: "html",
+				ErrorPage: config.ErrorPage{
+					ContentType: "text/html; charset=utf-8",
+					Template:    "<p>{{.Code}} {{.Msg}} {{.RequestId}}</p>",
+				},
+			},
+			{
+				ServiceName: "json",
+				ErrorPage: config.ErrorPage{
+					ContentType: "application/json",
+					Template:    `{"code":{{.Code}},"message":{{json .Msg}},"path":{{json .Path}}}`,
+				},
+			},
+		}})
+		Convey("json template escapes fields", func() {
+			w := httptest.NewRecorder()
+			pages.Write(w, "json", Page{Code: http.StatusUnauthorized, Msg: `bad","code":200,"x":"\`, Path: `/a"b`})
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			result := make(map[string]interface{})
+			So(jsoniter.Unmarshal(w.Body.Bytes(), &result), ShouldBeNil)
+			So(result["code"], ShouldEqual, 401)
+			So(result["message"], ShouldEqual, `bad","code":200,"x":"\`)
+			So(result["path"], ShouldEqual, `/a"b`)
+			So(result, ShouldNotContainKey, "x")
+		})
+		Convey("default json body", func() {
+			w := httptest.NewRecorder()
+			pages.Write(w, "test", Page{Code: http.StatusTooManyRequests, Msg: "too many requests", RequestId: "abc", RetryAfter: 2})
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "2")
+			So(w.Header().Get(RequestIdHeader), ShouldEqual, "abc")
+			result := make(map[string]interface{})
+			So(jsoniter.Unmarshal(w.Body.Bytes(), &result), ShouldBeNil)
+			So(result["RequestId"], ShouldEqual, "abc")
+		})
+		Convey("route template", func() {
+			w := httptest.NewRecorder()
+			pages.Write(w, "html", Page{Code: http.StatusBadGateway, Msg: "<upstream>", RequestId: "abc"})
+			So(w.Code, ShouldEqual, http.StatusBadGateway)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "text/html; charset=utf-8")
+			So(w.Body.String(), ShouldEqual, "<p>502 &lt;upstream&gt; abc</p>")
+		})
+		Convey("pages from context", func() {
+			w := httptest.NewRecorder()
+			FromContext(NewContext(context.Background(), pages)).Write(w, "html", Page{Code: http.StatusForbidden})
+			So(w.Header().Get("Content-Type"), ShouldEqual, "text/html; charset=utf-8")
+			w = httptest.NewRecorder()
+			FromContext(context.Background()).Write(w, "html", Page{Code: http.StatusForbidden})
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		})
+	})
+}
@@ -0,0 +1,46 @@
+package transmit
+
+import (
+	"time"
+
+	"simple_proxygateway/config"
+)
+
+var (
+	endpointEjectTime           = 30
+	endpointErrorCacheCleanTime = 60
+)
+
+// recordEndpointFailure 节点转发失败次数达到上限后暂时摘除
+func (p *Proxy) recordEndpointFailure(host string) {
+	if host == "" {
+		return
+	}
+	if errorCount, err := p.endpointErrorCache.IncrementInt(host, 1); err == nil {
+		if errorCount >= transmitErrorMaxCount {
+			p.endpointEjectCache.Set(host, struct{}{}, time.Duration(endpointEjectTime)*time.Second)
+			p.endpointErrorCache.Delete(host)
+		}
+		return
+	}
+	_ = p.endpointErrorCache.Add(host, 1, time.Duration(errorCacheDefaultExpiration)*time.Second)
+}
+
+func (p *Proxy) isEndpointHealthy(host string) bool {
+	_, ejected := p.endpointEjectCache.Get(host)
+	return !ejected
+}
+
+// filterHealthy 全部节点不可用时返回原节点，避免无节点可选
+func (p *Proxy) filterHealthy(urlSlice []config.ServiceUrlStruct) []config.ServiceUrlStruct {
+	healthySlice := make([]config.ServiceUrlStruct, 0, len(urlSlice))
+	for _, urlStruct := range urlSlice {
+		if p.isEndpointHealthy(urlStruct.Url) {
+			healthySlice = append(healthySlice, urlStruct)
+		}
+	}
+	if len(healthySlice) == 0 {
+		return urlSlice
+	}
+	return healthySlice
+}
@@ -2,19 +2,21 @@ package transmit
 
 import (
 	"hash/crc32"
+	"net/http"
 
 	"simple_proxygateway/config"
+	"simple_proxygateway/transmit/middleware"
 )
 
 type ipHashTransmit struct {
 }
 
 func init() {
-	register(config.LoadBalanceModeIpHash, &ipHashTransmit{})
+	RegisterBalancer(config.LoadBalanceModeIpHash, &ipHashTransmit{})
 }
 
-func (ipHashTransmit ipHashTransmit) getUrlString(urlSlice []config.ServiceUrlStruct, ip string) string {
+func (ipHashTransmit ipHashTransmit) Pick(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
 	sliceLen := len(urlSlice)
-	ipHash := crc32.ChecksumIEEE([]byte(ip))
+	ipHash := crc32.ChecksumIEEE([]byte(middleware.ClientIp(req)))
 	return urlSlice[int(ipHash)%sliceLen].Url
 }
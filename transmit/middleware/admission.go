@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"simple_proxygateway/config"
+)
+
+type (
+	// admissionClass 排队等级，priority 越小越优先
+	admissionClass struct {
+		name        string
+		priority    int
+		maxWait     time.Duration
+		routeMap    map[string]struct{}
+		consumerMap map[string]struct{}
+		tierMap     map[string]struct{}
+		headers     map[string]string
+		depth       int64 //正在排队的请求数，各限流key共用
+	}
+	// admissionClasses 按配置顺序匹配，最后一个为默认等级
+	admissionClasses []*admissionClass
+	// admissionQueue 等待令牌的请求，按等级及到达顺序排列的最小堆
+	admissionQueue []*queueWaiter
+	queueWaiter    struct {
+		class *admissionClass
+		seq   uint64
+		index int //堆中位置，出堆后为-1
+		ready chan struct{}
+	}
+)
+
+const defaultQueueClassName = "default"
+
+var defaultRestrictorQueueMaxSize = 100
+
+func newAdmissionClasses(queueConfig config.RestrictorQueue, waitTime int) admissionClasses {
+	classes := make(admissionClasses, 0, len(queueConfig.Classes)+1)
+	for i, classConfig := range queueConfig.Classes {
+		class := &admissionClass{
+			name:        classConfig.Name,
+			priority:    i,
+			maxWait:     time.Duration(classConfig.MaxWait) * time.Second,
+			routeMap:    make(map[string]struct{}),
+			consumerMap: make(map[string]struct{}),
+			tierMap:     make(map[string]struct{}),
+			headers:     classConfig.Headers,
+		}
+		for _, route := range classConfig.Routes {
+			class.routeMap[route] = struct{}{}
+		}
+		for _, consumer := range classConfig.Consumers {
+			class.consumerMap[consumer] = struct{}{}
+		}
+		for _, tier := range classConfig.Tiers {
+			class.tierMap[tier] = struct{}{}
+		}
+		classes = append(classes, class)
+	}
+	return append(classes, &admissionClass{
+		name:     defaultQueueClassName,
+		priority: len(queueConfig.Classes),
+		maxWait:  time.Duration(waitTime) * time.Second,
+	})
+}
+
+// class 请求匹配的第一个等级，均未匹配时为默认等级
+func (classes admissionClasses) class(r *http.Request) *admissionClass {
+	for _, class := range classes[:len(classes)-1] {
+		if class.match(r) {
+			return class
+		}
+	}
+	return classes[len(classes)-1]
+}
+
+// match 路由、接入方、接入方等级或header任一匹配
+func (class *admissionClass) match(r *http.Request) bool {
+	if _, ok := class.routeMap[RouteName(r.URL.Path)]; ok {
+		return true
+	}
+	if consumer, ok := ConsumerFrom(r); ok {
+		if _, ok = class.consumerMap[consumer.Id]; ok {
+			return true
+		}
+		if _, ok = class.tierMap[consumer.Tier]; ok && consumer.Tier != "" {
+			return true
+		}
+	}
+	for header, value := range class.headers {
+		if headerValue := r.Header.Get(header); headerValue != "" && (value == "" || value == headerValue) {
+			return true
+		}
+	}
+	return false
+}
+
+func (queue admissionQueue) Len() int {
+	return len(queue)
+}
+
+func (queue admissionQueue) Less(i, j int) bool {
+	if queue[i].class.priority != queue[j].class.priority {
+		return queue[i].class.priority < queue[j].class.priority
+	}
+	return queue[i].seq < queue[j].seq
+}
+
+func (queue admissionQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *admissionQueue) Push(x interface{}) {
+	waiter := x.(*queueWaiter)
+	waiter.index = len(*queue)
+	*queue = append(*queue, waiter)
+}
+
+func (queue *admissionQueue) Pop() interface{} {
+	old := *queue
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	waiter.index = -1
+	*queue = old[:len(old)-1]
+	return waiter
+}
+
+// queueDepth 各排队等级正在等待令牌的请求数
+func (classes admissionClasses) queueDepth() map[string]int64 {
+	depthMap := make(map[string]int64, len(classes))
+	for _, class := range classes {
+		depthMap[class.name] = atomic.LoadInt64(&class.depth)
+	}
+	return depthMap
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"net/http"
+
+	"simple_proxygateway/config"
+)
+
+type (
+	apiKeyParams struct {
+		Header         string   `yaml:"header"`          //读取api key的header，默认X-Api-Key
+		Query          string   `yaml:"query"`           //读取api key的query参数，默认api_key
+		ConsumerHeader string   `yaml:"consumer_header"` //转发至上游的接入方id header，默认X-Consumer-Id
+		Routes         []string `yaml:"routes"`          //需要api key的路由，为空时全部路由
+	}
+	apiKeyAuth struct {
+		params   apiKeyParams
+		routeMap map[string]struct{}
+	}
+)
+
+const (
+	defaultApiKeyHeader         = "X-Api-Key"
+	defaultApiKeyQuery          = "api_key"
+	defaultApiKeyConsumerHeader = "X-Consumer-Id"
+)
+
+func buildApiKeyHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	auth := apiKeyAuth{routeMap: make(map[string]struct{})}
+	if err := DecodeParams(params, &auth.params); err != nil {
+		return nil, err
+	}
+	if auth.params.Header == "" {
+		auth.params.Header = defaultApiKeyHeader
+	}
+	if auth.params.Query == "" {
+		auth.params.Query = defaultApiKeyQuery
+	}
+	if auth.params.ConsumerHeader == "" {
+		auth.params.ConsumerHeader = defaultApiKeyConsumerHeader
+	}
+	for _, route := range auth.params.Routes {
+		auth.routeMap[route] = struct{}{}
+	}
+	return MiddlewareFunc(auth.handle), nil
+}
+
+func (auth apiKeyAuth) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stripConsumerHeader(r, auth.params.ConsumerHeader)
+		routeName := RouteName(r.URL.Path)
+		if _, ok := auth.routeMap[routeName]; len(auth.routeMap) > 0 && !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(auth.params.ConsumerHeader)
+		apiKey := auth.takeApiKey(r)
+		store, ok := consumerStoreFrom(r)
+		if !ok {
+			Reject(w, r, &LimitError{Code: http.StatusServiceUnavailable, Msg: "consumer store unavailable"})
+			return
+		}
+		consumer, ok := store.GetConsumerByKeyHash(HashApiKey(apiKey))
+		if apiKey == "" || !ok {
+			Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: "invalid api key"})
+			return
+		}
+		if !consumer.AllowRoute(routeName) {
+			Reject(w, r, &LimitError{Code: ForbiddenErr.Code, Msg: "route not allowed"})
+			return
+		}
+		r.Header.Set(auth.params.ConsumerHeader, consumer.Id)
+		next.ServeHTTP(w, WithConsumer(r, consumer))
+	})
+}
+
+// takeApiKey 读取api key并从请求中移除，避免透传至上游
+func (auth apiKeyAuth) takeApiKey(r *http.Request) string {
+	if apiKey := r.Header.Get(auth.params.Header); apiKey != "" {
+		r.Header.Del(auth.params.Header)
+		return apiKey
+	}
+	query := r.URL.Query()
+	apiKey := query.Get(auth.params.Query)
+	if apiKey != "" {
+		query.Del(auth.params.Query)
+		r.URL.RawQuery = query.Encode()
+	}
+	return apiKey
+}
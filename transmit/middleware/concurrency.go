@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"simple_proxygateway/config"
+)
+
+type (
+	concurrencyParams struct {
+		InitialLimit     int      `yaml:"initial_limit"`     //初始并发数，默认20
+		MinLimit         int      `yaml:"min_limit"`         //默认1
+		MaxLimit         int      `yaml:"max_limit"`         //默认1000
+		BackoffRatio     float64  `yaml:"backoff_ratio"`     //过载时并发数乘以该系数，默认0.9
+		LatencyTolerance float64  `yaml:"latency_tolerance"` //耗时超过最小耗时的倍数时视为过载，默认2
+		MinRttWindow     int      `yaml:"min_rtt_window"`    //最小耗时的统计周期(秒)，默认30，周期结束后以该周期内的最小耗时为准
+		Routes           []string `yaml:"routes"`            //开启的路由，为空时全部路由
+	}
+	concurrencyLimit struct {
+		params         *concurrencyParams
+		routeMap       map[string]struct{}
+		hostMap        map[string]struct{}
+		defaultLimiter *aimdLimiter //未在 reverse_host 中配置的路由共用
+		limiterStore   *keyedStore  //上游服务 -> 并发数，同一路由切分的各服务独立计算
+	}
+	// ServiceResolver 解析请求实际转发的上游服务(含流量切分)，由转发实例实现，同一请求多次调用结果一致
+	ServiceResolver interface {
+		ResolveService(r *http.Request) string
+	}
+	serviceResolverKey struct{}
+	// localRejectKey 记录请求是否被后续中间件中断，中断时的503并非上游过载
+	localRejectKey struct{}
+	// aimdLimiter 加性增、乘性减：未过载且并发数已用到一半以上时逐步增加，上游返回502/503/504或耗时明显变长时按比例减少，
+	// 后续中间件中断的请求不参与调整
+	aimdLimiter struct {
+		mu           sync.Mutex
+		params       *concurrencyParams
+		limit        float64
+		inflight     int
+		minRtt       time.Duration
+		windowMinRtt time.Duration
+		windowStart  time.Time
+	}
+)
+
+var (
+	defaultConcurrencyParams = concurrencyParams{
+		InitialLimit:     20,
+		MinLimit:         1,
+		MaxLimit:         1000,
+		BackoffRatio:     0.9,
+		LatencyTolerance: 2,
+		MinRttWindow:     30,
+	}
+	ConcurrencyLimitedErr = &LimitError{Code: http.StatusServiceUnavailable, Msg: "service overloaded", RetryAfter: 1}
+	// 并发数按服务保存，服务来源于流量切分配置，超出时回收最久未使用的
+	concurrencyMaxServices = 1000
+	concurrencyIdleTimeout = 10 * time.Minute
+)
+
+func buildConcurrencyHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	limit, err := newConcurrencyLimit(proxyConfig, params)
+	if err != nil {
+		return nil, err
+	}
+	return MiddlewareFunc(limit.handle), nil
+}
+
+func newConcurrencyLimit(proxyConfig config.Client, params map[string]interface{}) (concurrencyLimit, error) {
+	limitParams := defaultConcurrencyParams
+	limit := concurrencyLimit{
+		params:       &limitParams,
+		routeMap:     make(map[string]struct{}),
+		hostMap:      make(map[string]struct{}),
+		limiterStore: newKeyedStore(concurrencyMaxServices, concurrencyIdleTimeout),
+	}
+	if err := DecodeParams(params, limit.params); err != nil {
+		return limit, err
+	}
+	if limit.params.MinLimit < 1 {
+		limit.params.MinLimit = 1
+	}
+	if limit.params.MaxLimit < limit.params.MinLimit {
+		limit.params.MaxLimit = limit.params.MinLimit
+	}
+	if limit.params.BackoffRatio <= 0 || limit.params.BackoffRatio >= 1 {
+		limit.params.BackoffRatio = defaultConcurrencyParams.BackoffRatio
+	}
+	if limit.params.LatencyTolerance <= 1 {
+		limit.params.LatencyTolerance = defaultConcurrencyParams.LatencyTolerance
+	}
+	if limit.params.MinRttWindow <= 0 {
+		limit.params.MinRttWindow = defaultConcurrencyParams.MinRttWindow
+	}
+	for _, route := range limit.params.Routes {
+		limit.routeMap[route] = struct{}{}
+	}
+	for _, host := range proxyConfig.ReverseHost {
+		limit.hostMap[host.ServiceName] = struct{}{}
+	}
+	limit.defaultLimiter = newAimdLimiter(limit.params, time.Now())
+	return limit, nil
+}
+
+func (limit concurrencyLimit) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routeName := RouteName(r.URL.Path)
+		if _, ok := limit.routeMap[routeName]; len(limit.routeMap) > 0 && !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limiter := limit.limiter(r, routeName, time.Now())
+		inflight, ok := limiter.acquire()
+		if !ok {
+			Reject(w, r, ConcurrencyLimitedErr)
+			return
+		}
+		observedWriter := NewObservedWriter(w)
+		localReject := new(bool)
+		start := time.Now()
+		defer func() {
+			if *localReject {
+				limiter.cancel()
+				return
+			}
+			now := time.Now()
+			limiter.release(now.Sub(start), isOverloadStatus(observedWriter.Status), inflight, now)
+		}()
+		next.ServeHTTP(observedWriter, r.WithContext(context.WithValue(r.Context(), localRejectKey{}, localReject)))
+	})
+}
+
+// limiter 各上游服务独立计算并发数，未配置的路由共用默认并发数，避免按客户端任意构造的路由创建
+func (limit concurrencyLimit) limiter(r *http.Request, routeName string, now time.Time) *aimdLimiter {
+	if _, ok := limit.hostMap[routeName]; !ok {
+		return limit.defaultLimiter
+	}
+	serviceName := routeName
+	if resolver, ok := r.Context().Value(serviceResolverKey{}).(ServiceResolver); ok && resolver != nil {
+		serviceName = resolver.ResolveService(r)
+	}
+	return limit.limiterStore.get(serviceName, now, func() interface{} {
+		return newAimdLimiter(limit.params, now)
+	}).(*aimdLimiter)
+}
+
+// NewServiceResolverContext 将服务解析写入请求上下文，由转发实例在请求进入中间件前设置
+func NewServiceResolverContext(ctx context.Context, resolver ServiceResolver) context.Context {
+	return context.WithValue(ctx, serviceResolverKey{}, resolver)
+}
+
+// markLocalReject 中间件中断请求时标记，并发数不按该响应调整
+func markLocalReject(r *http.Request) {
+	if localReject, ok := r.Context().Value(localRejectKey{}).(*bool); ok {
+		*localReject = true
+	}
+}
+
+func newAimdLimiter(params *concurrencyParams, now time.Time) *aimdLimiter {
+	initialLimit := math.Min(math.Max(float64(params.InitialLimit), float64(params.MinLimit)), float64(params.MaxLimit))
+	return &aimdLimiter{params: params, limit: initialLimit, windowStart: now}
+}
+
+// acquire 未超过并发数时占用，返回占用后的并发数
+func (limiter *aimdLimiter) acquire() (int, bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.inflight >= int(limiter.limit) {
+		return limiter.inflight, false
+	}
+	limiter.inflight++
+	return limiter.inflight, true
+}
+
+// cancel 请求未到达上游，释放但不调整并发数
+func (limiter *aimdLimiter) cancel() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.inflight--
+}
+
+// release 释放并按本次耗时及是否过载调整并发数，inflight 为请求开始时的并发数
+func (limiter *aimdLimiter) release(rtt time.Duration, overloaded bool, inflight int, now time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.inflight--
+	if !overloaded {
+		if limiter.minRtt > 0 && float64(rtt) > float64(limiter.minRtt)*limiter.params.LatencyTolerance {
+			overloaded = true
+		}
+		limiter.recordRtt(rtt, now)
+	}
+	if overloaded {
+		limiter.limit = math.Max(float64(limiter.params.MinLimit), limiter.limit*limiter.params.BackoffRatio)
+		return
+	}
+	//并发数未用到一半时说明限制并非瓶颈，不再增加
+	if float64(inflight)*2 >= limiter.limit {
+		limiter.limit = math.Min(float64(limiter.params.MaxLimit), limiter.limit+1/limiter.limit)
+	}
+}
+
+// recordRtt 记录最小耗时，周期结束后替换为该周期内的最小耗时，使上游扩缩容后基准随之变化
+func (limiter *aimdLimiter) recordRtt(rtt time.Duration, now time.Time) {
+	if rtt <= 0 {
+		return
+	}
+	if limiter.minRtt == 0 || rtt < limiter.minRtt {
+		limiter.minRtt = rtt
+	}
+	if limiter.windowMinRtt == 0 || rtt < limiter.windowMinRtt {
+		limiter.windowMinRtt = rtt
+	}
+	if now.Sub(limiter.windowStart) >= time.Duration(limiter.params.MinRttWindow)*time.Second {
+		limiter.minRtt = limiter.windowMinRtt
+		limiter.windowMinRtt = 0
+		limiter.windowStart = now
+	}
+}
+
+// currentLimit 当前允许的并发数
+func (limiter *aimdLimiter) currentLimit() int {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return int(limiter.limit)
+}
+
+func isOverloadStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
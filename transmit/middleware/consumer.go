@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"simple_proxygateway/config"
+)
+
+// ConsumerStore 接入方注册表，按api key的sha256摘要查询，由 etcd.LocalCache 实现
+type ConsumerStore interface {
+	GetConsumerByKeyHash(keyHash string) (config.Consumer, bool)
+}
+
+type (
+	consumerStoreKey struct{}
+	consumerKey      struct{}
+)
+
+// NewConsumerStoreContext 将接入方注册表写入请求上下文，由转发实例在请求进入中间件前设置
+func NewConsumerStoreContext(ctx context.Context, store ConsumerStore) context.Context {
+	return context.WithValue(ctx, consumerStoreKey{}, store)
+}
+
+func consumerStoreFrom(r *http.Request) (ConsumerStore, bool) {
+	store, ok := r.Context().Value(consumerStoreKey{}).(ConsumerStore)
+	return store, ok && store != nil
+}
+
+// ConsumerFrom 已认证的接入方，供后续中间件按接入方或限流等级处理
+func ConsumerFrom(r *http.Request) (config.Consumer, bool) {
+	consumer, ok := r.Context().Value(consumerKey{}).(config.Consumer)
+	return consumer, ok
+}
+
+// WithConsumer 认证中间件识别接入方后写入请求上下文
+func WithConsumer(r *http.Request, consumer config.Consumer) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), consumerKey{}, consumer))
+}
+
+// stripConsumerHeader 接入方header仅由认证中间件写入，尚未认证时移除客户端伪造的同名header，已认证时保留先前认证中间件写入的值
+func stripConsumerHeader(r *http.Request, header string) {
+	if _, ok := ConsumerFrom(r); !ok {
+		r.Header.Del(header)
+	}
+}
+
+// HashApiKey api key的sha256摘要(hex)，etcd中接入方的 key_hashes 使用该格式
+func HashApiKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
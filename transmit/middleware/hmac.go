@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"simple_proxygateway/config"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// SigningConsumerStore 按签名key id查询接入方，由 etcd.LocalCache 实现
+type SigningConsumerStore interface {
+	GetConsumerBySigningKey(keyId string) (config.Consumer, bool)
+}
+
+type (
+	hmacParams struct {
+		Routes         []string `yaml:"routes"`          //需要签名的路由，为空时全部路由
+		SignedHeaders  []string `yaml:"signed_headers"`  //参与签名的header，host为请求host
+		MaxSkew        int      `yaml:"max_skew"`        //时间戳允许误差(秒)，默认300
+		MaxBodySize    int64    `yaml:"max_body_size"`   //参与签名的请求体上限(字节)，默认10M
+		ConsumerHeader string   `yaml:"consumer_header"` //默认X-Consumer-Id
+	}
+	hmacAuth struct {
+		params     hmacParams
+		routeMap   map[string]struct{}
+		nonceCache *cache.Cache //key id + nonce，保存至时间戳超出误差范围
+	}
+)
+
+const (
+	SignatureKeyIdHeader     = "X-Signature-Key-Id"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+var (
+	defaultHmacMaxSkew           = 300
+	defaultHmacMaxBodySize int64 = 10 << 20
+	hmacMaxNonceLen              = 128
+
+	signatureMissingErr   = errors.New("signature missing")
+	signatureTimestampErr = errors.New("signature timestamp out of range")
+	signatureInvalidErr   = errors.New("signature invalid")
+	signatureReplayErr    = errors.New("signature nonce replayed")
+	bodyTooLargeErr       = errors.New("request body too large")
+)
+
+func buildHmacHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	auth := hmacAuth{routeMap: make(map[string]struct{})}
+	if err := DecodeParams(params, &auth.params); err != nil {
+		return nil, err
+	}
+	if auth.params.MaxSkew <= 0 {
+		auth.params.MaxSkew = defaultHmacMaxSkew
+	}
+	if auth.params.MaxBodySize <= 0 {
+		auth.params.MaxBodySize = defaultHmacMaxBodySize
+	}
+	if auth.params.ConsumerHeader == "" {
+		auth.params.ConsumerHeader = defaultApiKeyConsumerHeader
+	}
+	for _, route := range auth.params.Routes {
+		auth.routeMap[route] = struct{}{}
+	}
+	//时间戳前后均允许误差，nonce需保存两倍误差时间
+	nonceTtl := 2 * time.Duration(auth.params.MaxSkew) * time.Second
+	auth.nonceCache = cache.New(nonceTtl, nonceTtl)
+	return MiddlewareFunc(auth.handle), nil
+}
+
+func (auth hmacAuth) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stripConsumerHeader(r, auth.params.ConsumerHeader)
+		routeName := RouteName(r.URL.Path)
+		if _, ok := auth.routeMap[routeName]; len(auth.routeMap) > 0 && !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(auth.params.ConsumerHeader)
+		store, ok := consumerStoreFrom(r)
+		signingStore, isSigningStore := store.(SigningConsumerStore)
+		if !ok || !isSigningStore {
+			Reject(w, r, &LimitError{Code: http.StatusServiceUnavailable, Msg: "consumer store unavailable"})
+			return
+		}
+		body, err := readBody(r, auth.params.MaxBodySize)
+		if errors.Is(err, bodyTooLargeErr) {
+			Reject(w, r, &LimitError{Code: http.StatusRequestEntityTooLarge, Msg: err.Error()})
+			return
+		}
+		if err != nil {
+			Reject(w, r, &LimitError{Code: http.StatusBadRequest, Msg: "read request body failed"})
+			return
+		}
+		consumer, err := auth.verify(r, body, signingStore, time.Now())
+		if err != nil {
+			Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: err.Error()})
+			return
+		}
+		if !consumer.AllowRoute(routeName) {
+			Reject(w, r, &LimitError{Code: ForbiddenErr.Code, Msg: "route not allowed"})
+			return
+		}
+		r.Header.Set(auth.params.ConsumerHeader, consumer.Id)
+		next.ServeHTTP(w, WithConsumer(r, consumer))
+	})
+}
+
+// verify 依次校验时间戳、签名，签名通过后记录nonce，同一key id的nonce在误差范围内只能使用一次
+func (auth hmacAuth) verify(r *http.Request, body []byte, store SigningConsumerStore, now time.Time) (config.Consumer, error) {
+	keyId := r.Header.Get(SignatureKeyIdHeader)
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	nonce := r.Header.Get(SignatureNonceHeader)
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if keyId == "" || timestamp == "" || nonce == "" || len(nonce) > hmacMaxNonceLen || err != nil || len(signature) == 0 {
+		return config.Consumer{}, signatureMissingErr
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || now.Sub(time.Unix(unix, 0)) > time.Duration(auth.params.MaxSkew)*time.Second ||
+		time.Unix(unix, 0).Sub(now) > time.Duration(auth.params.MaxSkew)*time.Second {
+		return config.Consumer{}, signatureTimestampErr
+	}
+	consumer, ok := store.GetConsumerBySigningKey(keyId)
+	secret, hasSecret := consumer.SigningKeys[keyId]
+	if !ok || !hasSecret || secret == "" {
+		return config.Consumer{}, signatureInvalidErr
+	}
+	if !hmac.Equal(signature, sign(secret, CanonicalRequest(r, body, auth.params.SignedHeaders))) {
+		return config.Consumer{}, signatureInvalidErr
+	}
+	if err = auth.nonceCache.Add(keyId+"\n"+nonce, struct{}{}, cache.DefaultExpiration); err != nil {
+		return config.Consumer{}, signatureReplayErr
+	}
+	return consumer, nil
+}
+
+// CanonicalRequest 待签名内容，各部分以换行分隔：
+// 请求方法、path、按key排序的query、signed_headers(小写名称:去除首尾空格的值，按名称排序)、时间戳、nonce、请求体sha256(hex)
+func CanonicalRequest(r *http.Request, body []byte, signedHeaders []string) string {
+	query := r.URL.Query()
+	keySlice := make([]string, 0, len(query))
+	for key := range query {
+		keySlice = append(keySlice, key)
+	}
+	sort.Strings(keySlice)
+	querySlice := make([]string, 0, len(query))
+	for _, key := range keySlice {
+		valueSlice := append([]string(nil), query[key]...)
+		sort.Strings(valueSlice)
+		for _, value := range valueSlice {
+			querySlice = append(querySlice, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	headerSlice := make([]string, 0, len(signedHeaders))
+	for _, header := range signedHeaders {
+		header = strings.ToLower(header)
+		value := r.Header.Get(header)
+		if header == "host" {
+			value = r.Host
+		}
+		headerSlice = append(headerSlice, header+":"+strings.TrimSpace(value))
+	}
+	sort.Strings(headerSlice)
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(querySlice, "&"),
+		strings.Join(headerSlice, "\n"),
+		r.Header.Get(SignatureTimestampHeader),
+		r.Header.Get(SignatureNonceHeader),
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// SignRequest 按 CanonicalRequest 为请求签名，供调用方及测试使用，body 须与请求体一致
+func SignRequest(r *http.Request, body []byte, keyId string, secret string, nonce string, signedHeaders []string, now time.Time) {
+	r.Header.Set(SignatureKeyIdHeader, keyId)
+	r.Header.Set(SignatureTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	r.Header.Set(SignatureNonceHeader, nonce)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(sign(secret, CanonicalRequest(r, body, signedHeaders))))
+}
+
+func sign(secret string, canonicalRequest string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonicalRequest))
+	return mac.Sum(nil)
+}
+
+// readBody 读取请求体用于签名校验，读取后重新写回供上游使用
+func readBody(r *http.Request, maxBodySize int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, bodyTooLargeErr
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"net/http"
+
 	"simple_proxygateway/config"
 )
 
@@ -8,21 +10,22 @@ type ipTable struct {
 	blacklist map[string]struct{}
 }
 
-var ipTableHandler ipTable
-
-func buildIpTableHandler(proxyConfig config.Client) limiterHandler {
-	ipTableHandler = ipTable{
+func buildIpTableHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	ipTableHandler := ipTable{
 		blacklist: make(map[string]struct{}, 0),
 	}
 	for _, ip := range proxyConfig.IpTable {
 		ipTableHandler.blacklist[ip] = struct{}{}
 	}
-	return ipTableHandler
+	return MiddlewareFunc(ipTableHandler.handle), nil
 }
 
-func (handler ipTable) limiterHandleFunc(ip string) bool {
-	if _, ok := handler.blacklist[ip]; ok {
-		return false
-	}
-	return true
+func (handler ipTable) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := handler.blacklist[ClientIp(r)]; ok {
+			Reject(w, r, ForbiddenErr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
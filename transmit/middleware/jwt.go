@@ -0,0 +1,573 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	JwtAlgorithmHS256 = "HS256"
+	JwtAlgorithmRS256 = "RS256"
+	JwtAlgorithmES256 = "ES256"
+	JwtAlgorithmEdDSA = "EdDSA"
+)
+
+type (
+	jwtKey struct {
+		kid       string
+		algorithm string
+		key       interface{}
+	}
+	// jwtKeySet 路由的密钥集合，按来源分别保存，某一来源刷新失败时沿用上次加载的密钥
+	jwtKeySet struct {
+		keyFiles        []config.JwtKeyFile
+		jwksFile        string
+		jwksUrl         string
+		refreshInterval time.Duration
+		mu              sync.RWMutex
+		sourceKeyMap    map[string][]jwtKey
+		loadTime        time.Time
+		reloadMu        sync.Mutex
+		refreshing      int32
+	}
+	jwtRoute struct {
+		config       config.Jwt
+		keySet       *jwtKeySet
+		algorithmMap map[string]struct{}
+	}
+	jwtAuth struct {
+		routeMap map[string]*jwtRoute
+	}
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		K   string `json:"k"`
+	}
+	jwkSet struct {
+		Keys []jwk `json:"keys"`
+	}
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	jwtClaimsKey struct{}
+)
+
+var (
+	jwtAlgorithmSlice         = []string{JwtAlgorithmHS256, JwtAlgorithmRS256, JwtAlgorithmES256, JwtAlgorithmEdDSA}
+	defaultJwtRefreshInterval = 300
+	// 出现未知kid时提前刷新的最小间隔，避免伪造kid频繁请求jwks
+	jwtMinRefreshInterval = 10 * time.Second
+	jwksHttpClient        = &http.Client{Timeout: 5 * time.Second}
+
+	jwtMissingErr       = errors.New("token missing")
+	jwtMalformedErr     = errors.New("token malformed")
+	jwtAlgorithmErr     = errors.New("token algorithm not allowed")
+	jwtSignatureErr     = errors.New("token signature invalid")
+	jwtExpiredErr       = errors.New("token expired")
+	jwtNotValidYetErr   = errors.New("token not valid yet")
+	jwtIssuerErr        = errors.New("token issuer invalid")
+	jwtAudienceErr      = errors.New("token audience invalid")
+	jwtRequiredClaimErr = errors.New("token required claim missing")
+	jwtEmptyKeyErr      = errors.New("empty hmac key")
+)
+
+func buildJwtHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	auth := jwtAuth{routeMap: make(map[string]*jwtRoute)}
+	for _, host := range proxyConfig.ReverseHost {
+		if !host.Jwt.Open {
+			continue
+		}
+		//密钥文件无效时启动失败，避免空密钥等配置错误在运行时才暴露
+		for _, keyFile := range host.Jwt.KeyFiles {
+			if _, err := loadJwtKeyFile(keyFile); err != nil {
+				return nil, fmt.Errorf("route %s load jwt key file %s err:%w", host.ServiceName, keyFile.Path, err)
+			}
+		}
+		auth.routeMap[host.ServiceName] = newJwtRoute(host.Jwt)
+	}
+	return MiddlewareFunc(auth.handle), nil
+}
+
+// newJwtRoute 创建并加载密钥，密钥加载失败时该路由拒绝全部请求，不会放行
+func newJwtRoute(jwtConfig config.Jwt) *jwtRoute {
+	route := &jwtRoute{
+		config:       jwtConfig,
+		keySet:       newJwtKeySet(jwtConfig),
+		algorithmMap: make(map[string]struct{}),
+	}
+	algorithmSlice := jwtConfig.Algorithms
+	if len(algorithmSlice) == 0 {
+		algorithmSlice = jwtAlgorithmSlice
+	}
+	for _, algorithm := range algorithmSlice {
+		route.algorithmMap[algorithm] = struct{}{}
+	}
+	route.keySet.reload()
+	return route
+}
+
+func (auth jwtAuth) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := auth.routeMap[RouteName(r.URL.Path)]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, header := range route.config.ClaimHeaders {
+			r.Header.Del(header)
+		}
+		claims, err := route.verify(bearerToken(r), time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: err.Error()})
+			return
+		}
+		for claim, header := range route.config.ClaimHeaders {
+			if value, ok := claims[claim]; ok {
+				r.Header.Set(header, claimString(value))
+			}
+		}
+		ctx := context.WithValue(r.Context(), jwtClaimsKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// JwtClaims 已通过校验的jwt claims，供后续中间件使用
+func JwtClaims(r *http.Request) (map[string]interface{}, bool) {
+	claims, ok := r.Context().Value(jwtClaimsKey{}).(map[string]interface{})
+	return claims, ok
+}
+
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// verify 校验签名及iss、aud、exp、nbf和必需claim
+func (route *jwtRoute) verify(token string, now time.Time) (map[string]interface{}, error) {
+	if token == "" {
+		return nil, jwtMissingErr
+	}
+	pieceSlice := strings.Split(token, ".")
+	if len(pieceSlice) != 3 {
+		return nil, jwtMalformedErr
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(pieceSlice[0])
+	if err != nil {
+		return nil, jwtMalformedErr
+	}
+	header := jwtHeader{}
+	if err = jsoniter.Unmarshal(headerJson, &header); err != nil {
+		return nil, jwtMalformedErr
+	}
+	if _, ok := route.algorithmMap[header.Alg]; !ok {
+		return nil, jwtAlgorithmErr
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(pieceSlice[2])
+	if err != nil {
+		return nil, jwtMalformedErr
+	}
+	signingInput := []byte(pieceSlice[0] + "." + pieceSlice[1])
+	if !route.verifySignature(header, signingInput, signature, now) {
+		return nil, jwtSignatureErr
+	}
+	claimsJson, err := base64.RawURLEncoding.DecodeString(pieceSlice[1])
+	if err != nil {
+		return nil, jwtMalformedErr
+	}
+	claims := make(map[string]interface{})
+	if err = jsoniter.Unmarshal(claimsJson, &claims); err != nil {
+		return nil, jwtMalformedErr
+	}
+	if err = route.verifyClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature 密钥类型须与算法一致，kid未命中时提前刷新一次密钥
+func (route *jwtRoute) verifySignature(header jwtHeader, signingInput []byte, signature []byte, now time.Time) bool {
+	keySlice, kidFound := route.keySet.keys(header.Kid, now)
+	if !kidFound && header.Kid != "" && route.keySet.refreshForKid(now) {
+		keySlice, _ = route.keySet.keys(header.Kid, now)
+	}
+	for _, key := range keySlice {
+		if key.algorithm == header.Alg && verifyJwtSignature(key, signingInput, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (route *jwtRoute) verifyClaims(claims map[string]interface{}, now time.Time) error {
+	leeway := float64(route.config.Leeway)
+	exp, ok := claims["exp"].(float64)
+	if !ok || float64(now.Unix()) > exp+leeway {
+		return jwtExpiredErr
+	}
+	if nbfObj, ok := claims["nbf"]; ok {
+		nbf, ok := nbfObj.(float64)
+		if !ok || float64(now.Unix()) < nbf-leeway {
+			return jwtNotValidYetErr
+		}
+	}
+	if route.config.Issuer != "" {
+		if issuer, _ := claims["iss"].(string); issuer != route.config.Issuer {
+			return jwtIssuerErr
+		}
+	}
+	if len(route.config.Audience) > 0 && !audienceMatch(claims["aud"], route.config.Audience) {
+		return jwtAudienceErr
+	}
+	for _, claim := range route.config.RequiredClaims {
+		if value, ok := claims[claim]; !ok || value == nil || value == "" {
+			return fmt.Errorf("%w:%s", jwtRequiredClaimErr, claim)
+		}
+	}
+	return nil
+}
+
+// audienceMatch aud可以为字符串或字符串数组
+func audienceMatch(audience interface{}, audienceSlice []string) bool {
+	tokenAudienceSlice := make([]string, 0, 1)
+	switch value := audience.(type) {
+	case string:
+		tokenAudienceSlice = append(tokenAudienceSlice, value)
+	case []interface{}:
+		for _, item := range value {
+			if itemString, ok := item.(string); ok {
+				tokenAudienceSlice = append(tokenAudienceSlice, itemString)
+			}
+		}
+	}
+	for _, tokenAudience := range tokenAudienceSlice {
+		for _, expected := range audienceSlice {
+			if tokenAudience == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString 数组以逗号拼接，对象输出json
+func claimString(value interface{}) string {
+	switch claim := value.(type) {
+	case string:
+		return claim
+	case float64:
+		return strconv.FormatFloat(claim, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(claim)
+	case []interface{}:
+		itemSlice := make([]string, 0, len(claim))
+		for _, item := range claim {
+			itemSlice = append(itemSlice, claimString(item))
+		}
+		return strings.Join(itemSlice, ",")
+	}
+	claimJson, _ := jsoniter.Marshal(value)
+	return string(claimJson)
+}
+
+func verifyJwtSignature(key jwtKey, signingInput []byte, signature []byte) bool {
+	hash := sha256.Sum256(signingInput)
+	switch publicKey := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, publicKey)
+		mac.Write(signingInput)
+		return hmac.Equal(signature, mac.Sum(nil))
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		//ES256签名为r、s各32字节拼接
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, hash[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(publicKey, signingInput, signature)
+	}
+	return false
+}
+
+// keyAlgorithm 按密钥类型确定唯一可用的算法，避免算法混淆
+func keyAlgorithm(key interface{}) string {
+	switch publicKey := key.(type) {
+	case []byte:
+		return JwtAlgorithmHS256
+	case *rsa.PublicKey:
+		return JwtAlgorithmRS256
+	case *ecdsa.PublicKey:
+		if publicKey.Curve == elliptic.P256() {
+			return JwtAlgorithmES256
+		}
+	case ed25519.PublicKey:
+		return JwtAlgorithmEdDSA
+	}
+	return ""
+}
+
+func newJwtKeySet(jwtConfig config.Jwt) *jwtKeySet {
+	refreshInterval := jwtConfig.RefreshInterval
+	if refreshInterval <= 0 {
+		refreshInterval = defaultJwtRefreshInterval
+	}
+	return &jwtKeySet{
+		keyFiles:        jwtConfig.KeyFiles,
+		jwksFile:        jwtConfig.JwksFile,
+		jwksUrl:         jwtConfig.JwksUrl,
+		refreshInterval: time.Duration(refreshInterval) * time.Second,
+		sourceKeyMap:    make(map[string][]jwtKey),
+	}
+}
+
+// keys 返回kid对应的密钥，token未携带kid时返回全部密钥，第二个返回值为是否存在匹配的密钥；超过刷新间隔时异步刷新
+func (keySet *jwtKeySet) keys(kid string, now time.Time) ([]jwtKey, bool) {
+	keySet.mu.RLock()
+	defer keySet.mu.RUnlock()
+	if now.Sub(keySet.loadTime) >= keySet.refreshInterval && atomic.CompareAndSwapInt32(&keySet.refreshing, 0, 1) {
+		go func(loadTime time.Time) {
+			defer atomic.StoreInt32(&keySet.refreshing, 0)
+			keySet.refreshIfStale(loadTime)
+		}(keySet.loadTime)
+	}
+	keySlice := make([]jwtKey, 0)
+	for _, sourceKeySlice := range keySet.sourceKeyMap {
+		for _, key := range sourceKeySlice {
+			//未配置kid的密钥可校验任意kid的token
+			if kid == "" || key.kid == "" || key.kid == kid {
+				keySlice = append(keySlice, key)
+			}
+		}
+	}
+	return keySlice, len(keySlice) > 0
+}
+
+// refreshForKid 距上次加载超过最小间隔时同步刷新，返回是否已刷新
+func (keySet *jwtKeySet) refreshForKid(now time.Time) bool {
+	keySet.mu.RLock()
+	loadTime := keySet.loadTime
+	keySet.mu.RUnlock()
+	if now.Sub(loadTime) < jwtMinRefreshInterval {
+		return false
+	}
+	return keySet.refreshIfStale(loadTime)
+}
+
+// refreshIfStale 并发刷新时只执行一次，其余调用等待结果
+func (keySet *jwtKeySet) refreshIfStale(loadTime time.Time) bool {
+	keySet.reloadMu.Lock()
+	defer keySet.reloadMu.Unlock()
+	keySet.mu.RLock()
+	reloaded := !keySet.loadTime.Equal(loadTime)
+	keySet.mu.RUnlock()
+	if !reloaded {
+		keySet.reload()
+	}
+	return true
+}
+
+func (keySet *jwtKeySet) reload() {
+	sourceKeyMap := make(map[string][]jwtKey)
+	for _, keyFile := range keySet.keyFiles {
+		key, err := loadJwtKeyFile(keyFile)
+		if err != nil {
+			logger.Runtime.Error(fmt.Sprintf("load jwt key file %s err:%s", keyFile.Path, err.Error()))
+			continue
+		}
+		sourceKeyMap["file:"+keyFile.Path] = []jwtKey{key}
+	}
+	if keySet.jwksFile != "" {
+		if jwksJson, err := ioutil.ReadFile(keySet.jwksFile); err != nil {
+			logger.Runtime.Error(fmt.Sprintf("load jwks file %s err:%s", keySet.jwksFile, err.Error()))
+		} else {
+			sourceKeyMap["jwks_file"] = parseJwks(jwksJson)
+		}
+	}
+	if keySet.jwksUrl != "" {
+		if jwksJson, err := fetchJwks(keySet.jwksUrl); err != nil {
+			logger.Runtime.Error(fmt.Sprintf("load jwks url %s err:%s", keySet.jwksUrl, err.Error()))
+		} else {
+			sourceKeyMap["jwks_url"] = parseJwks(jwksJson)
+		}
+	}
+	keySet.mu.Lock()
+	defer keySet.mu.Unlock()
+	for source, keySlice := range sourceKeyMap {
+		keySet.sourceKeyMap[source] = keySlice
+	}
+	keySet.loadTime = time.Now()
+}
+
+func fetchJwks(jwksUrl string) ([]byte, error) {
+	resp, err := jwksHttpClient.Get(jwksUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status:%d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// loadJwtKeyFile HS256读取原始密钥，其他算法读取PEM格式公钥或证书
+func loadJwtKeyFile(keyFile config.JwtKeyFile) (jwtKey, error) {
+	content, err := ioutil.ReadFile(keyFile.Path)
+	if err != nil {
+		return jwtKey{}, err
+	}
+	var key interface{}
+	if keyFile.Algorithm == JwtAlgorithmHS256 {
+		secret := bytes.TrimRight(content, "\r\n")
+		if len(secret) == 0 {
+			return jwtKey{}, jwtEmptyKeyErr
+		}
+		key = secret
+	} else {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return jwtKey{}, errors.New("invalid pem")
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return jwtKey{}, err
+			}
+			key = cert.PublicKey
+		case "RSA PUBLIC KEY":
+			if key, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+				return jwtKey{}, err
+			}
+		default:
+			if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				return jwtKey{}, err
+			}
+		}
+	}
+	algorithm := keyAlgorithm(key)
+	if algorithm == "" || (keyFile.Algorithm != "" && keyFile.Algorithm != algorithm) {
+		return jwtKey{}, fmt.Errorf("key type does not match algorithm %s", keyFile.Algorithm)
+	}
+	return jwtKey{kid: keyFile.Kid, algorithm: algorithm, key: key}, nil
+}
+
+// parseJwks 跳过不支持或非签名用途的密钥
+func parseJwks(jwksJson []byte) []jwtKey {
+	set := jwkSet{}
+	if err := jsoniter.Unmarshal(jwksJson, &set); err != nil {
+		logger.Runtime.Error("parse jwks err:" + err.Error())
+		return nil
+	}
+	keySlice := make([]jwtKey, 0, len(set.Keys))
+	for _, item := range set.Keys {
+		if item.Use != "" && item.Use != "sig" {
+			continue
+		}
+		key, err := item.publicKey()
+		if err != nil {
+			logger.Runtime.Error(fmt.Sprintf("parse jwk %s err:%s", item.Kid, err.Error()))
+			continue
+		}
+		algorithm := keyAlgorithm(key)
+		if algorithm == "" || (item.Alg != "" && item.Alg != algorithm) {
+			continue
+		}
+		keySlice = append(keySlice, jwtKey{kid: item.Kid, algorithm: algorithm, key: key})
+	}
+	return keySlice
+}
+
+func (item jwk) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch item.Kty {
+	case "oct":
+		secret, err := decode(item.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, jwtEmptyKeyErr
+		}
+		return secret, nil
+	case "RSA":
+		n, err := decode(item.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(item.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if item.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + item.Crv)
+		}
+		x, err := decode(item.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(item.Y)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, errors.New("point not on curve")
+		}
+		return publicKey, nil
+	case "OKP":
+		if item.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve " + item.Crv)
+		}
+		x, err := decode(item.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported kty " + item.Kty)
+}
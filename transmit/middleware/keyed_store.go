@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type (
+	// keyedStore 按key保存限流状态，超出数量时回收最久未使用的，访问时顺带回收空闲项，不需要额外的清理协程
+	keyedStore struct {
+		mu          sync.Mutex
+		maxKeys     int
+		idleTimeout time.Duration
+		itemList    *list.List //最近使用的位于队首
+		itemMap     map[string]*list.Element
+	}
+	keyedItem struct {
+		key      string
+		value    interface{}
+		lastSeen time.Time
+	}
+)
+
+func newKeyedStore(maxKeys int, idleTimeout time.Duration) *keyedStore {
+	return &keyedStore{
+		maxKeys:     maxKeys,
+		idleTimeout: idleTimeout,
+		itemList:    list.New(),
+		itemMap:     make(map[string]*list.Element),
+	}
+}
+
+// get 返回key对应的值，不存在时调用create创建
+func (store *keyedStore) get(key string, now time.Time, create func() interface{}) interface{} {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.evictIdle(now)
+	if element, ok := store.itemMap[key]; ok {
+		item := element.Value.(*keyedItem)
+		item.lastSeen = now
+		store.itemList.MoveToFront(element)
+		return item.value
+	}
+	item := &keyedItem{key: key, value: create(), lastSeen: now}
+	store.itemMap[key] = store.itemList.PushFront(item)
+	for store.maxKeys > 0 && store.itemList.Len() > store.maxKeys {
+		store.remove(store.itemList.Back())
+	}
+	return item.value
+}
+
+func (store *keyedStore) len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.itemList.Len()
+}
+
+// evictIdle 队尾为最久未使用的项，依次回收直到遇到未空闲的项
+func (store *keyedStore) evictIdle(now time.Time) {
+	for element := store.itemList.Back(); element != nil; element = store.itemList.Back() {
+		if now.Sub(element.Value.(*keyedItem).lastSeen) < store.idleTimeout {
+			return
+		}
+		store.remove(element)
+	}
+}
+
+func (store *keyedStore) remove(element *list.Element) {
+	store.itemList.Remove(element)
+	delete(store.itemMap, element.Value.(*keyedItem).key)
+}
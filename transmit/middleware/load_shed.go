@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+)
+
+type (
+	loadShedParams struct {
+		MaxGoroutines   int `yaml:"max_goroutines"`    //goroutine数，0为不检查
+		MaxHeapMb       int `yaml:"max_heap_mb"`       //堆上存活及待清扫对象(MB)，0为不检查
+		MaxSchedLatency int `yaml:"max_sched_latency"` //采样区间内goroutine调度延迟p99(毫秒)，0为不检查
+		MaxInflight     int `yaml:"max_inflight"`      //经过该中间件正在处理的请求数，0为不检查
+		SampleInterval  int `yaml:"sample_interval"`   //运行时指标采样间隔(毫秒)，默认100
+		//不丢弃的 restrictor.queue.classes 等级，为空时保留所有已配置等级，仅丢弃未匹配等级的请求
+		KeepClasses []string `yaml:"keep_classes"`
+	}
+	loadShed struct {
+		params   loadShedParams
+		classes  admissionClasses
+		keepMap  map[string]struct{}
+		inflight int64
+		shedding int32
+		monitor  *healthMonitor
+	}
+	// healthMonitor 按采样间隔在请求中读取运行时指标，不单独启动goroutine
+	healthMonitor struct {
+		mu           sync.Mutex
+		interval     time.Duration
+		sampleTime   time.Time
+		sampleSlice  []metrics.Sample
+		latencySlice []uint64 //上次采样时调度延迟直方图的累计计数
+		health       processHealth
+	}
+	processHealth struct {
+		goroutines   int
+		heapBytes    uint64
+		schedLatency time.Duration
+	}
+)
+
+const (
+	heapObjectsMetric    = "/memory/classes/heap/objects:bytes"
+	schedLatenciesMetric = "/sched/latencies:seconds"
+)
+
+var (
+	defaultLoadShedSampleInterval = 100
+	LoadShedErr                   = &LimitError{Code: http.StatusServiceUnavailable, Msg: "gateway overloaded", RetryAfter: 1}
+)
+
+func buildLoadShedHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	shed := &loadShed{keepMap: make(map[string]struct{})}
+	if err := DecodeParams(params, &shed.params); err != nil {
+		return nil, err
+	}
+	if shed.params.SampleInterval <= 0 {
+		shed.params.SampleInterval = defaultLoadShedSampleInterval
+	}
+	shed.classes = newAdmissionClasses(proxyConfig.Restrictor.Queue, proxyConfig.Restrictor.WaitTime)
+	keepClasses := shed.params.KeepClasses
+	if len(keepClasses) == 0 {
+		for _, class := range proxyConfig.Restrictor.Queue.Classes {
+			keepClasses = append(keepClasses, class.Name)
+		}
+	}
+	for _, className := range keepClasses {
+		shed.keepMap[className] = struct{}{}
+	}
+	shed.monitor = newHealthMonitor(time.Duration(shed.params.SampleInterval) * time.Millisecond)
+	return MiddlewareFunc(shed.handle), nil
+}
+
+func (shed *loadShed) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight := atomic.AddInt64(&shed.inflight, 1)
+		defer atomic.AddInt64(&shed.inflight, -1)
+		if reason := shed.overloaded(int(inflight), time.Now()); reason != "" {
+			if _, ok := shed.keepMap[shed.classes.class(r).name]; !ok {
+				Reject(w, r, LoadShedErr)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// overloaded 任一指标超过阈值时返回原因，进入及退出丢弃状态时记录日志
+func (shed *loadShed) overloaded(inflight int, now time.Time) string {
+	reason := ""
+	if shed.params.MaxInflight > 0 && inflight > shed.params.MaxInflight {
+		reason = fmt.Sprintf("inflight:%d", inflight)
+	} else if shed.params.MaxGoroutines > 0 || shed.params.MaxHeapMb > 0 || shed.params.MaxSchedLatency > 0 {
+		health := shed.monitor.sample(now)
+		switch {
+		case shed.params.MaxGoroutines > 0 && health.goroutines > shed.params.MaxGoroutines:
+			reason = fmt.Sprintf("goroutines:%d", health.goroutines)
+		case shed.params.MaxHeapMb > 0 && health.heapBytes > uint64(shed.params.MaxHeapMb)<<20:
+			reason = fmt.Sprintf("heap:%dMB", health.heapBytes>>20)
+		case shed.params.MaxSchedLatency > 0 && health.schedLatency > time.Duration(shed.params.MaxSchedLatency)*time.Millisecond:
+			reason = fmt.Sprintf("sched latency:%s", health.schedLatency)
+		}
+	}
+	if reason != "" && atomic.CompareAndSwapInt32(&shed.shedding, 0, 1) {
+		logger.Runtime.Warn("load shedding started, " + reason)
+	} else if reason == "" && atomic.CompareAndSwapInt32(&shed.shedding, 1, 0) {
+		logger.Runtime.Info("load shedding stopped")
+	}
+	return reason
+}
+
+func newHealthMonitor(interval time.Duration) *healthMonitor {
+	return &healthMonitor{
+		interval:    interval,
+		sampleSlice: []metrics.Sample{{Name: heapObjectsMetric}, {Name: schedLatenciesMetric}},
+	}
+}
+
+// sample 距上次采样超过采样间隔时重新读取，调度延迟取两次采样之间新增部分的p99
+func (monitor *healthMonitor) sample(now time.Time) processHealth {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	if now.Sub(monitor.sampleTime) < monitor.interval {
+		return monitor.health
+	}
+	monitor.sampleTime = now
+	metrics.Read(monitor.sampleSlice)
+	health := processHealth{goroutines: runtime.NumGoroutine()}
+	if value := monitor.sampleSlice[0].Value; value.Kind() == metrics.KindUint64 {
+		health.heapBytes = value.Uint64()
+	}
+	if value := monitor.sampleSlice[1].Value; value.Kind() == metrics.KindFloat64Histogram {
+		histogram := value.Float64Histogram()
+		if len(monitor.latencySlice) == len(histogram.Counts) {
+			health.schedLatency = histogramPercentile(histogram.Buckets, histogram.Counts, monitor.latencySlice, 0.99)
+		}
+		monitor.latencySlice = append(monitor.latencySlice[:0], histogram.Counts...)
+	}
+	monitor.health = health
+	return health
+}
+
+// histogramPercentile 两次累计计数之差的分位数，取所在区间的下界
+func histogramPercentile(buckets []float64, counts []uint64, before []uint64, percentile float64) time.Duration {
+	var total uint64
+	for i := range counts {
+		total += counts[i] - before[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	var cumulative uint64
+	for i := range counts {
+		cumulative += counts[i] - before[i]
+		if float64(cumulative) >= percentile*float64(total) {
+			if buckets[i] <= 0 {
+				return 0
+			}
+			return time.Duration(buckets[i] * float64(time.Second))
+		}
+	}
+	return 0
+}
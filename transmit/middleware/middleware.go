@@ -1,55 +1,245 @@
 package middleware
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"strings"
+
 	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+	"simple_proxygateway/transmit/errorpage"
 )
 
-type limiterHandler interface {
-	limiterHandleFunc(ip string) bool
+type (
+	// Middleware 包装下一个处理器，调用 next.ServeHTTP 继续执行，不调用则中断请求；
+	// 可直接响应请求、通过 r.WithContext 写入请求上下文，或包装 ResponseWriter 观察响应
+	Middleware interface {
+		Handle(next http.Handler) http.Handler
+	}
+	// MiddlewareFunc 函数形式的 Middleware
+	MiddlewareFunc func(next http.Handler) http.Handler
+	// Gauger 可选接口，中间件实现后由网关实例定时读取指标写入采集，key 为指标名称
+	Gauger interface {
+		Gauges() map[string]int64
+	}
+	// Chain 组装后的中间件链
+	Chain struct {
+		handler     http.Handler
+		gaugerSlice []Gauger
+	}
+	// Builder 根据网关配置及中间件 params 构建中间件，返回错误时网关启动失败，避免认证、限流等中间件未生效时放行请求
+	Builder func(proxyConfig config.Client, params map[string]interface{}) (Middleware, error)
+)
+
+func (f MiddlewareFunc) Handle(next http.Handler) http.Handler {
+	return f(next)
 }
 
-type buildHandlerFunc func(proxyConfig config.Client) limiterHandler
+// LimitError 中间件拒绝请求的原因，Code 为返回的http状态码
+type LimitError struct {
+	Code       int
+	Msg        string
+	RetryAfter int //建议重试间隔(秒)，0为不返回Retry-After
+}
 
-type LimiterStruct struct {
-	limiterSlice []limiterHandler
-	proxyConfig  config.Client
+func (err *LimitError) Error() string {
+	return err.Msg
 }
 
-var Limiter *LimiterStruct
+var (
+	ForbiddenErr    = &LimitError{Code: http.StatusForbidden, Msg: "access denied"}
+	RateLimitedErr  = &LimitError{Code: http.StatusTooManyRequests, Msg: "too many requests", RetryAfter: 1}
+	UnauthorizedErr = &LimitError{Code: http.StatusUnauthorized, Msg: "unauthorized"}
+
+	MiddlewareNotExistsErr = errors.New("middleware not exists")
+)
+
+const (
+	IpTableName     = "ip_table"
+	RestrictorName  = "restrictor"
+	JwtName         = "jwt"
+	ApiKeyName      = "api_key"
+	MtlsName        = "mtls"
+	OidcName        = "oidc"
+	HmacName        = "hmac"
+	ConcurrencyName = "concurrency"
+	LoadShedName    = "load_shed"
+)
+
+var (
+	builderMap = make(map[string]Builder)
+	// 未配置middleware时的默认顺序
+	defaultMiddlewareSlice = []config.Middleware{
+		{Name: IpTableName, Open: true},
+		{Name: JwtName, Open: true},
+		{Name: RestrictorName, Open: true},
+	}
+)
+
+type clientIpKey struct{}
 
 func init() {
-	newLimiter()
+	Register(IpTableName, buildIpTableHandler)
+	Register(RestrictorName, buildRestrictorHandler)
+	Register(JwtName, buildJwtHandler)
+	Register(ApiKeyName, buildApiKeyHandler)
+	Register(MtlsName, buildMtlsHandler)
+	Register(OidcName, buildOidcHandler)
+	Register(HmacName, buildHmacHandler)
+	Register(ConcurrencyName, buildConcurrencyHandler)
+	Register(LoadShedName, buildLoadShedHandler)
 }
 
-func newLimiter() {
-	lStruct := &LimiterStruct{
-		limiterSlice: make([]limiterHandler, 0),
+// Register 注册中间件，name 对应配置中 middleware.name，重复注册时保留首次注册
+// 自定义中间件在 init 中调用 Register，并在网关 main 包中引入所在包即可编译进网关
+func Register(name string, builder Builder) {
+	if _, ok := builderMap[name]; ok {
+		logger.Runtime.Error(fmt.Sprintf("middleware already registered:%s", name))
+		return
 	}
-	Limiter = lStruct
+	builderMap[name] = builder
 }
 
-func (Limiter *LimiterStruct) SetConfig(proxyConfig config.Client) {
-	Limiter.proxyConfig = proxyConfig
-	Limiter.use(buildIpTableHandler, buildRestrictorHandler)
+// DecodeParams 将配置中的 params 解析至自定义结构体，结构体字段使用yaml标签
+func DecodeParams(params map[string]interface{}, out interface{}) error {
+	return config.DecodeParams(params, out)
 }
 
-func (Limiter *LimiterStruct) Handle(remoteAddr string) bool {
-	var result bool
-	ip, _, _ := net.SplitHostPort(remoteAddr)
-	if ip == "::1" {
-		ip = "127.0.0.1"
+// NewChain 按配置顺序组装中间件，请求依次经过各中间件后到达handler，开启的中间件未注册或构建失败时返回错误
+func NewChain(proxyConfig config.Client, handler http.Handler) (*Chain, error) {
+	chain := &Chain{}
+	middlewareSlice := proxyConfig.Middleware
+	if len(middlewareSlice) == 0 {
+		middlewareSlice = defaultMiddlewareSlice
 	}
-	for _, handler := range Limiter.limiterSlice {
-		if result = handler.limiterHandleFunc(ip); !result {
-			return false
+	handlerSlice := []Middleware{MiddlewareFunc(requestIdHandler)}
+	for _, middleware := range middlewareSlice {
+		if !middleware.Open {
+			continue
+		}
+		builder, ok := builderMap[middleware.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w:%s", MiddlewareNotExistsErr, middleware.Name)
 		}
+		handle, err := builder(proxyConfig, middleware.Params)
+		if err != nil {
+			return nil, fmt.Errorf("build middleware %s err:%w", middleware.Name, err)
+		}
+		handlerSlice = append(handlerSlice, handle)
+		if gauger, ok := handle.(Gauger); ok {
+			chain.gaugerSlice = append(chain.gaugerSlice, gauger)
+		}
+	}
+	for i := len(handlerSlice) - 1; i >= 0; i-- {
+		handler = handlerSlice[i].Handle(handler)
 	}
-	return true
+	chain.handler = handler
+	return chain, nil
 }
 
-func (Limiter *LimiterStruct) use(handles ...buildHandlerFunc) {
-	for _, handle := range handles {
-		Limiter.limiterSlice = append(Limiter.limiterSlice, handle(Limiter.proxyConfig))
+func (chain *Chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chain.handler.ServeHTTP(w, r)
+}
+
+// Gauges 链中各中间件的当前指标
+func (chain *Chain) Gauges() map[string]int64 {
+	gaugeMap := make(map[string]int64)
+	for _, gauger := range chain.gaugerSlice {
+		for name, value := range gauger.Gauges() {
+			gaugeMap[name] = value
+		}
 	}
+	return gaugeMap
+}
+
+// requestIdHandler 客户端未携带请求id时生成，并透传至上游及响应
+func requestIdHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(errorpage.RequestIdHeader)
+		if requestId == "" {
+			requestId = errorpage.NewRequestId()
+			r.Header.Set(errorpage.RequestIdHeader, requestId)
+		}
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip == "::1" {
+			ip = "127.0.0.1"
+		}
+		ctx := context.WithValue(r.Context(), clientIpKey{}, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ClientIp 请求来源ip
+func ClientIp(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIpKey{}).(string); ok {
+		return ip
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
+
+// RouteName path第一位为路由名称
+func RouteName(path string) string {
+	pathPieceSlice := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	return pathPieceSlice[0]
+}
+
+// Reject 中断请求并按路由错误页返回
+func Reject(w http.ResponseWriter, r *http.Request, limitErr *LimitError) {
+	markLocalReject(r)
+	errorpage.FromContext(r.Context()).Write(w, RouteName(r.URL.Path), errorpage.Page{
+		Code:       limitErr.Code,
+		Msg:        limitErr.Msg,
+		RequestId:  r.Header.Get(errorpage.RequestIdHeader),
+		Path:       r.URL.Path,
+		RetryAfter: limitErr.RetryAfter,
+	})
+}
+
+// ObservedWriter 记录响应状态码及长度，供中间件观察响应
+type ObservedWriter struct {
+	http.ResponseWriter
+	Status int
+	Size   int
+}
+
+func NewObservedWriter(w http.ResponseWriter) *ObservedWriter {
+	return &ObservedWriter{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (w *ObservedWriter) WriteHeader(code int) {
+	w.Status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ObservedWriter) Write(data []byte) (int, error) {
+	size, err := w.ResponseWriter.Write(data)
+	w.Size += size
+	return size, err
+}
+
+// Flush 流式响应需要透传Flush
+func (w *ObservedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack websocket等协议升级需要透传Hijack
+func (w *ObservedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.Status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap 供 http.ResponseController 获取原始 ResponseWriter
+func (w *ObservedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
@@ -1,17 +1,47 @@
 package middleware
 
 import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"simple_proxygateway/config"
+	"simple_proxygateway/transmit/errorpage"
 
+	jsoniter "github.com/json-iterator/go"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 var (
 	proxyConfig *config.Client
+	okHandler   = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
 )
 
 func TestMain(m *testing.M) {
@@ -20,45 +50,1281 @@ func TestMain(m *testing.M) {
 	m.Run()
 }
 
-func TestSetConfig(t *testing.T) {
-	Convey("set config", t, func() {
-		Limiter.SetConfig(*proxyConfig)
-		So(len(Limiter.limiterSlice), ShouldEqual, 2)
+func serve(handler http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/test/get", nil)
+	req.RemoteAddr = remoteAddr
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// mustNewChain 测试配置均应构建成功
+func mustNewChain(proxyConfig config.Client, handler http.Handler) http.Handler {
+	chain, err := NewChain(proxyConfig, handler)
+	if err != nil {
+		panic(err)
+	}
+	return chain
+}
+
+func TestNewChain(t *testing.T) {
+	Convey("new chain", t, func() {
+		chain := mustNewChain(*proxyConfig, okHandler)
+		Convey("request passes and gets request id", func() {
+			w := serve(chain, "127.0.0.1:80")
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("request id forwarded", func() {
+			var requestId string
+			chain := mustNewChain(*proxyConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestId = r.Header.Get(errorpage.RequestIdHeader)
+			}))
+			serve(chain, "127.0.0.1:80")
+			So(requestId, ShouldNotBeEmpty)
+		})
+		Convey("closed middleware skipped", func() {
+			closeConfig := *proxyConfig
+			closeConfig.IpTable = []string{"127.0.0.1"}
+			closeConfig.Middleware = []config.Middleware{{Name: IpTableName, Open: false}}
+			w := serve(mustNewChain(closeConfig, okHandler), "127.0.0.1:80")
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("unknown or invalid middleware fails", func() {
+			failConfig := *proxyConfig
+			failConfig.Middleware = []config.Middleware{{Name: "ip_tabel", Open: true}}
+			_, err := NewChain(failConfig, okHandler)
+			So(errors.Is(err, MiddlewareNotExistsErr), ShouldBeTrue)
+			failConfig.Middleware = []config.Middleware{{Name: HmacName, Open: true, Params: map[string]interface{}{"routes": "webhook"}}}
+			_, err = NewChain(failConfig, okHandler)
+			So(err, ShouldNotBeNil)
+			failConfig.Middleware = []config.Middleware{{Name: RestrictorName, Open: true}}
+			failConfig.Restrictor.Algorithm = "leaky_bucket"
+			_, err = NewChain(failConfig, okHandler)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// hijackRecorder 支持Hijack的ResponseRecorder
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestObservedWriter(t *testing.T) {
+	Convey("observed writer passes through hijack", t, func() {
+		recorder := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+		w := NewObservedWriter(recorder)
+		_, _, err := w.Hijack()
+		So(err, ShouldBeNil)
+		So(recorder.hijacked, ShouldBeTrue)
+		So(w.Status, ShouldEqual, http.StatusSwitchingProtocols)
+		So(w.Unwrap(), ShouldEqual, recorder)
+		_, _, err = NewObservedWriter(httptest.NewRecorder()).Hijack()
+		So(err, ShouldEqual, http.ErrNotSupported)
 	})
 }
 
 func TestIpTable(t *testing.T) {
 	Convey("set config", t, func() {
-		proxyConfig.IpTable = append(proxyConfig.IpTable, "127.0.0.1")
-		Limiter.SetConfig(*proxyConfig)
+		ipConfig := *proxyConfig
+		ipConfig.IpTable = append(ipConfig.IpTable, "127.0.0.1")
+		chain := mustNewChain(ipConfig, okHandler)
 		Convey("handle remoteAddr", func() {
-			result := Limiter.Handle("127.0.0.1:80")
-			So(result, ShouldBeFalse)
+			So(serve(chain, "127.0.0.1:80").Code, ShouldEqual, http.StatusForbidden)
+			So(serve(chain, "[::1]:80").Code, ShouldEqual, http.StatusForbidden)
+			So(serve(chain, "127.0.0.3:80").Code, ShouldEqual, http.StatusOK)
 		})
 	})
 }
 
 func TestRestrictor(t *testing.T) {
 	Convey("set config", t, func() {
-		proxyConfig.Restrictor.Rate = 1
-		proxyConfig.Restrictor.MaxToken = 10
-		Limiter.SetConfig(*proxyConfig)
+		restrictorConfig := *proxyConfig
+		restrictorConfig.Restrictor.Open = true
+		restrictorConfig.Restrictor.Rate = 1
+		restrictorConfig.Restrictor.MaxToken = 10
+		restrictorConfig.Restrictor.WaitTime = 1
+		chain := mustNewChain(restrictorConfig, okHandler)
 		Convey("handle remoteAddr", func() {
-			var successCount int64
+			var successCount, limitedCount int64
 			var wg sync.WaitGroup
-			successCount, times := 0, 20
+			times := 20
 			for i := 0; i < times; i++ {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					result := Limiter.Handle("127.0.0.1:80")
-					if result {
+					w := serve(chain, "127.0.0.1:80")
+					if w.Code == http.StatusOK {
 						atomic.AddInt64(&successCount, 1)
+					} else if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "" {
+						atomic.AddInt64(&limitedCount, 1)
 					}
 				}()
 			}
 			wg.Wait()
 			So(successCount, ShouldBeLessThan, times)
+			So(successCount+limitedCount, ShouldEqual, times)
+		})
+	})
+	Convey("keyed token buckets", t, func() {
+		restrictorConfig := *proxyConfig
+		restrictorConfig.Middleware = []config.Middleware{{Name: RestrictorName, Open: true}}
+		restrictorConfig.Restrictor = config.Restrictor{
+			Open: true, Rate: 1, MaxToken: 2, Key: config.RestrictorKeyConsumer,
+			Routes: map[string]config.RestrictorLimit{"other": {Rate: 1, MaxToken: 1}},
+			Tiers:  map[string]config.RestrictorLimit{"gold": {Rate: 1, MaxToken: 4}},
+		}
+		chain := mustNewChain(restrictorConfig, okHandler)
+		serveAs := func(target string, remoteAddr string, consumer *config.Consumer) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", target, nil)
+			req.RemoteAddr = remoteAddr
+			if consumer != nil {
+				req = WithConsumer(req, *consumer)
+			}
+			chain.ServeHTTP(w, req)
+			return w.Code
+		}
+		countOk := func(target string, remoteAddr string, consumer *config.Consumer) int {
+			okCount := 0
+			for i := 0; i < 6; i++ {
+				if serveAs(target, remoteAddr, consumer) == http.StatusOK {
+					okCount++
+				}
+			}
+			return okCount
+		}
+		Convey("one client cannot use up other clients' budget", func() {
+			So(countOk("/test/get", "10.0.0.1:80", nil), ShouldEqual, 2)
+			So(countOk("/test/get", "10.0.0.2:80", nil), ShouldEqual, 2)
+			So(countOk("/test/get", "10.0.0.3:80", &config.Consumer{Id: "a"}), ShouldEqual, 2)
+			So(countOk("/test/get", "10.0.0.3:80", &config.Consumer{Id: "b"}), ShouldEqual, 2)
+		})
+		Convey("route and tier limits", func() {
+			So(countOk("/other/get", "10.0.0.4:80", nil), ShouldEqual, 1)
+			So(countOk("/test/get", "10.0.0.5:80", &config.Consumer{Id: "c", Tier: "gold"}), ShouldEqual, 4)
+			So(countOk("/test/get", "10.0.0.5:80", &config.Consumer{Id: "d", Tier: "silver"}), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestRateLimitWindows(t *testing.T) {
+	windows := []config.RestrictorWindow{{Limit: 3, Window: 10}, {Limit: 5, Window: 60}}
+	Convey("sliding window log", t, func() {
+		now := time.Unix(1000, 0)
+		bucket := newSlidingWindowLog(windows)
+		for i := 0; i < 3; i++ {
+			So(bucket.take(context.Background(), now.Add(time.Duration(i)*time.Second), 1, nil).allowed, ShouldBeTrue)
+		}
+		status := bucket.take(context.Background(), now.Add(3*time.Second), 1, nil)
+		So(status.allowed, ShouldBeFalse)
+		So(status.limit, ShouldEqual, 3)
+		So(status.remaining, ShouldEqual, 0)
+		//第一个请求移出10秒窗口
+		So(status.retryAfter, ShouldEqual, 7)
+		status = bucket.take(context.Background(), now.Add(10*time.Second), 1, nil)
+		So(status.allowed, ShouldBeTrue)
+		So(status.limit, ShouldEqual, 3)
+		So(status.remaining, ShouldEqual, 0)
+		So(bucket.take(context.Background(), now.Add(11*time.Second), 1, nil).allowed, ShouldBeTrue)
+		//10秒窗口已恢复，但60秒窗口内已有5次
+		status = bucket.take(context.Background(), now.Add(30*time.Second), 1, nil)
+		So(status.allowed, ShouldBeFalse)
+		So(status.limit, ShouldEqual, 5)
+		So(status.retryAfter, ShouldEqual, 30)
+		So(bucket.take(context.Background(), now.Add(60*time.Second), 1, nil).allowed, ShouldBeTrue)
+	})
+	Convey("sliding window counter", t, func() {
+		now := time.Unix(1200, 0)
+		bucket := newSlidingWindowCounter([]config.RestrictorWindow{{Limit: 4, Window: 10}})
+		for i := 0; i < 4; i++ {
+			So(bucket.take(context.Background(), now, 1, nil).allowed, ShouldBeTrue)
+		}
+		status := bucket.take(context.Background(), now.Add(5*time.Second), 1, nil)
+		So(status.allowed, ShouldBeFalse)
+		So(status.reset, ShouldEqual, 5)
+		//下一窗口开始时上一窗口的4次按权重计入，2.5秒后降至3次以下
+		So(bucket.take(context.Background(), now.Add(10*time.Second), 1, nil).allowed, ShouldBeFalse)
+		status = bucket.take(context.Background(), now.Add(12*time.Second), 1, nil)
+		So(status.allowed, ShouldBeFalse)
+		So(status.retryAfter, ShouldEqual, 1)
+		So(bucket.take(context.Background(), now.Add(13*time.Second), 1, nil).allowed, ShouldBeTrue)
+		So(bucket.take(context.Background(), now.Add(30*time.Second), 1, nil).remaining, ShouldEqual, 3)
+	})
+	Convey("cluster share", t, func() {
+		bucket := newSlidingWindowLog([]config.RestrictorWindow{{Limit: 4, Window: 10}})
+		now := time.Unix(1400, 0)
+		So(bucket.take(context.Background(), now, 2, nil).allowed, ShouldBeTrue)
+		So(bucket.take(context.Background(), now, 2, nil).allowed, ShouldBeTrue)
+		So(bucket.take(context.Background(), now, 2, nil).allowed, ShouldBeFalse)
+	})
+	Convey("rate limit headers", t, func() {
+		restrictorConfig := *proxyConfig
+		restrictorConfig.Middleware = []config.Middleware{{Name: RestrictorName, Open: true}}
+		restrictorConfig.Restrictor = config.Restrictor{
+			Open: true, Key: config.RestrictorKeyIp, Algorithm: config.RestrictorAlgorithmSlidingWindowLog,
+			Windows: []config.RestrictorWindow{{Limit: 2, Window: 3600}},
+			Routes:  map[string]config.RestrictorLimit{"other": {Windows: []config.RestrictorWindow{{Limit: 1, Window: 60}}}},
+		}
+		chain := mustNewChain(restrictorConfig, okHandler)
+		serveTarget := func(target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", target, nil)
+			req.RemoteAddr = "10.0.2.1:80"
+			chain.ServeHTTP(w, req)
+			return w
+		}
+		w := serveTarget("/test/get")
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "2")
+		So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "1")
+		So(w.Header().Get("RateLimit-Reset"), ShouldEqual, "3600")
+		So(serveTarget("/test/get").Code, ShouldEqual, http.StatusOK)
+		w = serveTarget("/test/get")
+		So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+		So(w.Header().Get("Retry-After"), ShouldNotBeEmpty)
+		So(serveTarget("/other/get").Code, ShouldEqual, http.StatusOK)
+		w = serveTarget("/other/get")
+		So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "1")
+	})
+	Convey("sliding window requires windows", t, func() {
+		restrictorConfig := *proxyConfig
+		restrictorConfig.Middleware = []config.Middleware{{Name: RestrictorName, Open: true}}
+		restrictorConfig.Restrictor = config.Restrictor{Open: true, Rate: 10, MaxToken: 10, Algorithm: config.RestrictorAlgorithmSlidingWindowCounter}
+		_, err := NewChain(restrictorConfig, okHandler)
+		So(errors.Is(err, RestrictorWindowsErr), ShouldBeTrue)
+		restrictorConfig.Restrictor.Windows = []config.RestrictorWindow{{Limit: 10, Window: 60}}
+		restrictorConfig.Restrictor.Routes = map[string]config.RestrictorLimit{"other": {Windows: []config.RestrictorWindow{{Limit: 10}}}}
+		_, err = NewChain(restrictorConfig, okHandler)
+		So(errors.Is(err, RestrictorWindowsErr), ShouldBeTrue)
+		restrictorConfig.Restrictor.Routes = nil
+		_, err = NewChain(restrictorConfig, okHandler)
+		So(err, ShouldBeNil)
+	})
+	Convey("token bucket headers", t, func() {
+		bucket := newTokenBucket(config.RestrictorLimit{Rate: 1, MaxToken: 2}, defaultRestrictorQueueMaxSize)
+		status := bucket.take(context.Background(), time.Now(), 1, newAdmissionClasses(config.RestrictorQueue{}, 0)[0])
+		So(status.allowed, ShouldBeTrue)
+		So(status.limit, ShouldEqual, 2)
+		So(status.remaining, ShouldEqual, 1)
+		So(status.reset, ShouldEqual, 1)
+	})
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	classes := newAdmissionClasses(config.RestrictorQueue{Classes: []config.RestrictorQueueClass{
+		{Name: "test_checkout", MaxWait: 2, Routes: []string{"checkout"}, Tiers: []string{"gold"}},
+		{Name: "test_export", MaxWait: 2, Headers: map[string]string{"X-Export": ""}},
+	}}, 0)
+	newRequest := func(target string, header string, consumer *config.Consumer) *http.Request {
+		req := httptest.NewRequest("GET", target, nil)
+		if header != "" {
+			req.Header.Set(header, "1")
+		}
+		if consumer != nil {
+			req = WithConsumer(req, *consumer)
+		}
+		return req
+	}
+	waitDepth := func(className string, depth int64) {
+		for i := 0; i < 100 && classes.queueDepth()[className] != depth; i++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	Convey("match class", t, func() {
+		So(classes.class(newRequest("/checkout/pay", "", nil)).name, ShouldEqual, "test_checkout")
+		So(classes.class(newRequest("/test/get", "", &config.Consumer{Id: "a", Tier: "gold"})).name, ShouldEqual, "test_checkout")
+		So(classes.class(newRequest("/test/get", "X-Export", nil)).name, ShouldEqual, "test_export")
+		So(classes.class(newRequest("/test/get", "", &config.Consumer{Id: "b"})).name, ShouldEqual, defaultQueueClassName)
+	})
+	Convey("higher class admitted first", t, func() {
+		bucket := newTokenBucket(config.RestrictorLimit{Rate: 10, MaxToken: 1}, 10)
+		So(bucket.take(context.Background(), time.Now(), 1, classes[0]).allowed, ShouldBeTrue)
+		//没有令牌且默认等级不排队
+		So(bucket.take(context.Background(), time.Now(), 1, classes[2]).allowed, ShouldBeFalse)
+		orderChan := make(chan string, 2)
+		takeAs := func(class *admissionClass) {
+			if bucket.take(context.Background(), time.Now(), 1, class).allowed {
+				orderChan <- class.name
+			}
+		}
+		go takeAs(classes[1])
+		waitDepth("test_export", 1)
+		go takeAs(classes[0])
+		waitDepth("test_checkout", 1)
+		So(<-orderChan, ShouldEqual, "test_checkout")
+		So(<-orderChan, ShouldEqual, "test_export")
+		So(classes.queueDepth()["test_checkout"], ShouldEqual, 0)
+		So(classes.queueDepth()["test_export"], ShouldEqual, 0)
+	})
+	Convey("queue depth per restrictor instance", t, func() {
+		restrictorConfig := *proxyConfig
+		restrictorConfig.Middleware = []config.Middleware{{Name: RestrictorName, Open: true}}
+		restrictorConfig.Restrictor = config.Restrictor{Open: true, Rate: 1, MaxToken: 1, WaitTime: 2, Key: config.RestrictorKeyIp}
+		first, second := mustNewChain(restrictorConfig, okHandler).(*Chain), mustNewChain(restrictorConfig, okHandler).(*Chain)
+		So(serve(first, "10.0.3.1:80").Code, ShouldEqual, http.StatusOK)
+		done := make(chan int)
+		go func() {
+			done <- serve(first, "10.0.3.1:80").Code
+		}()
+		gauge := RestrictorQueueDepthGauge + "." + defaultQueueClassName
+		for i := 0; i < 100 && first.Gauges()[gauge] != 1; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		So(first.Gauges()[gauge], ShouldEqual, 1)
+		So(second.Gauges()[gauge], ShouldEqual, 0)
+		So(<-done, ShouldEqual, http.StatusOK)
+		So(first.Gauges()[gauge], ShouldEqual, 0)
+	})
+	Convey("bounded queue", t, func() {
+		bucket := newTokenBucket(config.RestrictorLimit{Rate: 1, MaxToken: 1}, 1)
+		So(bucket.take(context.Background(), time.Now(), 1, classes[1]).allowed, ShouldBeTrue)
+		ctx, cancel := context.WithCancel(context.Background())
+		resultChan := make(chan bool)
+		go func() {
+			resultChan <- bucket.take(ctx, time.Now(), 1, classes[1]).allowed
+		}()
+		waitDepth("test_export", 1)
+		//队列已满
+		status := bucket.take(context.Background(), time.Now(), 1, classes[0])
+		So(status.allowed, ShouldBeFalse)
+		So(status.retryAfter, ShouldEqual, 1)
+		cancel()
+		So(<-resultChan, ShouldBeFalse)
+		So(classes.queueDepth()["test_export"], ShouldEqual, 0)
+	})
+}
+
+type fixedClusterSizer struct {
+	size  int
+	fresh bool
+}
+
+func (sizer *fixedClusterSizer) ClusterSize() (int, bool) {
+	return sizer.size, sizer.fresh
+}
+
+func TestClusterRestrictor(t *testing.T) {
+	Convey("cluster restrictor", t, func() {
+		restrictorConfig := *proxyConfig
+		restrictorConfig.Middleware = []config.Middleware{{Name: RestrictorName, Open: true}}
+		restrictorConfig.Restrictor = config.Restrictor{
+			Open: true, Rate: 1, MaxToken: 4, Key: config.RestrictorKeyIp,
+			Cluster: config.RestrictorCluster{Open: true},
+		}
+		chain := mustNewChain(restrictorConfig, okHandler)
+		sizer := &fixedClusterSizer{size: 2, fresh: true}
+		countOk := func(remoteAddr string) int {
+			okCount := 0
+			for i := 0; i < 6; i++ {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", "/test/get", nil)
+				req.RemoteAddr = remoteAddr
+				chain.ServeHTTP(w, req.WithContext(NewClusterSizerContext(req.Context(), sizer)))
+				if w.Code == http.StatusOK {
+					okCount++
+				}
+			}
+			return okCount
+		}
+		Convey("budget split by member count", func() {
+			So(countOk("10.0.1.1:80"), ShouldEqual, 2)
+			sizer.size = 4
+			So(countOk("10.0.1.2:80"), ShouldEqual, 1)
+		})
+		Convey("fall back to local limit", func() {
+			sizer.fresh = false
+			So(countOk("10.0.1.3:80"), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestKeyedStore(t *testing.T) {
+	Convey("keyed store eviction", t, func() {
+		now := time.Now()
+		store := newKeyedStore(2, time.Minute)
+		created := 0
+		create := func() interface{} {
+			created++
+			return created
+		}
+		So(store.get("a", now, create), ShouldEqual, 1)
+		So(store.get("b", now, create), ShouldEqual, 2)
+		So(store.get("a", now, create), ShouldEqual, 1)
+		//超出数量时回收最久未使用的b
+		So(store.get("c", now, create), ShouldEqual, 3)
+		So(store.len(), ShouldEqual, 2)
+		So(store.get("b", now, create), ShouldEqual, 4)
+		//空闲超时的项在访问时回收
+		So(store.get("d", now.Add(2*time.Minute), create), ShouldEqual, 5)
+		So(store.len(), ShouldEqual, 1)
+	})
+}
+
+type tagParams struct {
+	Header string `yaml:"header"`
+	Value  string `yaml:"value"`
+}
+
+func TestRegister(t *testing.T) {
+	var observedStatus int
+	Register("tag", func(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+		tag := tagParams{}
+		if err := DecodeParams(params, &tag); err != nil {
+			return nil, err
+		}
+		return MiddlewareFunc(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Set(tag.Header, tag.Value)
+				observedWriter := NewObservedWriter(w)
+				next.ServeHTTP(observedWriter, r)
+				observedStatus = observedWriter.Status
+			})
+		}), nil
+	})
+	Convey("register custom middleware", t, func() {
+		tagConfig := *proxyConfig
+		tagConfig.Middleware = []config.Middleware{
+			{Name: "tag", Open: true, Params: map[string]interface{}{"header": "X-Tag", "value": "1"}},
+		}
+		var header string
+		chain := mustNewChain(tagConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header.Get("X-Tag")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		w := serve(chain, "127.0.0.1:80")
+		So(w.Code, ShouldEqual, http.StatusAccepted)
+		So(header, ShouldEqual, "1")
+		So(observedStatus, ShouldEqual, http.StatusAccepted)
+	})
+}
+
+type jwtSigner struct {
+	algorithm string
+	kid       string
+	key       interface{}
+}
+
+func (signer jwtSigner) sign(claims map[string]interface{}) string {
+	headerJson, _ := jsoniter.Marshal(map[string]string{"alg": signer.algorithm, "kid": signer.kid, "typ": "JWT"})
+	claimsJson, _ := jsoniter.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	hash := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch key := signer.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, hash[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writePublicKeyPem(t *testing.T, path string, publicKey interface{}) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ed25519Jwks(kid string, publicKey ed25519.PublicKey) []byte {
+	jwksJson, _ := jsoniter.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": kid, "x": base64.RawURLEncoding.EncodeToString(publicKey)},
+	}})
+	return jwksJson
+}
+
+func serveToken(handler http.Handler, path string, token string, header http.Header) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestJwt(t *testing.T) {
+	dir := t.TempDir()
+	hmacSecret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rotatePublic, rotateKey, _ := ed25519.GenerateKey(rand.Reader)
+	_ = ioutil.WriteFile(filepath.Join(dir, "hs.key"), append(hmacSecret, '\n'), 0600)
+	writePublicKeyPem(t, filepath.Join(dir, "rsa.pem"), &rsaKey.PublicKey)
+	writePublicKeyPem(t, filepath.Join(dir, "ec.pem"), &ecKey.PublicKey)
+	_ = ioutil.WriteFile(filepath.Join(dir, "jwks.json"), ed25519Jwks("ed", edPublic), 0600)
+	var jwksBody atomic.Value
+	jwksBody.Store(ed25519Jwks("old", rotatePublic))
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwksBody.Load().([]byte))
+	}))
+	defer jwksServer.Close()
+
+	jwtConfig := *proxyConfig
+	jwtConfig.Middleware = []config.Middleware{{Name: JwtName, Open: true}}
+	jwtConfig.ReverseHost = []config.ReverseHost{
+		{
+			ServiceName: "test",
+			Jwt: config.Jwt{
+				Open:           true,
+				Issuer:         "gateway",
+				Audience:       []string{"test"},
+				RequiredClaims: []string{"sub"},
+				KeyFiles: []config.JwtKeyFile{
+					{Kid: "hs", Algorithm: JwtAlgorithmHS256, Path: filepath.Join(dir, "hs.key")},
+					{Kid: "rsa", Path: filepath.Join(dir, "rsa.pem")},
+					{Kid: "ec", Algorithm: JwtAlgorithmES256, Path: filepath.Join(dir, "ec.pem")},
+				},
+				JwksFile:     filepath.Join(dir, "jwks.json"),
+				ClaimHeaders: map[string]string{"sub": "X-User", "roles": "X-Roles"},
+			},
+		},
+		{
+			ServiceName: "rotate",
+			Jwt:         config.Jwt{Open: true, JwksUrl: jwksServer.URL},
+		},
+		{ServiceName: "public"},
+	}
+	var forwarded http.Header
+	chain := mustNewChain(jwtConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	now := time.Now().Unix()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "gateway", "aud": []string{"other", "test"}, "sub": "user-1", "roles": []string{"a", "b"}, "exp": now + 60}
+	}
+	hsSigner := jwtSigner{algorithm: JwtAlgorithmHS256, kid: "hs", key: hmacSecret}
+
+	Convey("every algorithm accepted", t, func() {
+		for _, signer := range []jwtSigner{
+			hsSigner,
+			{algorithm: JwtAlgorithmRS256, kid: "rsa", key: rsaKey},
+			{algorithm: JwtAlgorithmES256, kid: "ec", key: ecKey},
+			{algorithm: JwtAlgorithmEdDSA, kid: "ed", key: edKey},
+		} {
+			forwarded = nil
+			w := serveToken(chain, "/test/get", signer.sign(validClaims()), http.Header{"X-User": {"forged"}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Get("X-User"), ShouldEqual, "user-1")
+			So(forwarded.Get("X-Roles"), ShouldEqual, "a,b")
+		}
+	})
+
+	Convey("invalid tokens rejected", t, func() {
+		w := serveToken(chain, "/test/get", "", nil)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		So(w.Header().Get("WWW-Authenticate"), ShouldNotBeEmpty)
+		for _, modify := range []func(claims map[string]interface{}){
+			func(claims map[string]interface{}) { claims["exp"] = now - 10 },
+			func(claims map[string]interface{}) { delete(claims, "exp") },
+			func(claims map[string]interface{}) { claims["nbf"] = now + 60 },
+			func(claims map[string]interface{}) { claims["iss"] = "other" },
+			func(claims map[string]interface{}) { claims["aud"] = "other" },
+			func(claims map[string]interface{}) { delete(claims, "sub") },
+		} {
+			claims := validClaims()
+			modify(claims)
+			So(serveToken(chain, "/test/get", hsSigner.sign(claims), nil).Code, ShouldEqual, http.StatusUnauthorized)
+		}
+		Convey("wrong key or algorithm", func() {
+			wrongSecret := jwtSigner{algorithm: JwtAlgorithmHS256, kid: "hs", key: []byte("other")}
+			So(serveToken(chain, "/test/get", wrongSecret.sign(validClaims()), nil).Code, ShouldEqual, http.StatusUnauthorized)
+			none := jwtSigner{algorithm: "none", kid: "hs"}
+			So(serveToken(chain, "/test/get", none.sign(validClaims()), nil).Code, ShouldEqual, http.StatusUnauthorized)
+			//使用rsa公钥作为hmac密钥伪造
+			rsaPem, _ := ioutil.ReadFile(filepath.Join(dir, "rsa.pem"))
+			confusion := jwtSigner{algorithm: JwtAlgorithmHS256, kid: "rsa", key: rsaPem}
+			So(serveToken(chain, "/test/get", confusion.sign(validClaims()), nil).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+
+	Convey("route without jwt passes", t, func() {
+		w := serveToken(chain, "/public/get", "", http.Header{"X-User": {"client"}})
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(forwarded.Get("X-User"), ShouldEqual, "client")
+	})
+
+	Convey("empty hmac key rejected", t, func() {
+		emptyConfig := *proxyConfig
+		emptyConfig.Middleware = []config.Middleware{{Name: JwtName, Open: true}}
+		_ = ioutil.WriteFile(filepath.Join(dir, "empty.key"), []byte("\n"), 0600)
+		emptyConfig.ReverseHost = []config.ReverseHost{{
+			ServiceName: "test",
+			Jwt: config.Jwt{Open: true, KeyFiles: []config.JwtKeyFile{
+				{Kid: "empty", Algorithm: JwtAlgorithmHS256, Path: filepath.Join(dir, "empty.key")},
+			}},
+		}}
+		_, err := NewChain(emptyConfig, http.NotFoundHandler())
+		So(err, ShouldNotBeNil)
+
+		emptyJwks, _ := jsoniter.Marshal(map[string]interface{}{"keys": []map[string]string{{"kty": "oct", "kid": "empty", "k": ""}}})
+		_ = ioutil.WriteFile(filepath.Join(dir, "empty.json"), emptyJwks, 0600)
+		emptyConfig.ReverseHost = []config.ReverseHost{{
+			ServiceName: "test",
+			Jwt:         config.Jwt{Open: true, JwksFile: filepath.Join(dir, "empty.json")},
+		}}
+		emptyChain := mustNewChain(emptyConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		emptySigner := jwtSigner{algorithm: JwtAlgorithmHS256, kid: "empty", key: []byte{}}
+		So(serveToken(emptyChain, "/test/get", emptySigner.sign(validClaims()), nil).Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("jwks url refreshed on unknown kid", t, func() {
+		newPublic, newKey, _ := ed25519.GenerateKey(rand.Reader)
+		oldSigner := jwtSigner{algorithm: JwtAlgorithmEdDSA, kid: "old", key: rotateKey}
+		newSigner := jwtSigner{algorithm: JwtAlgorithmEdDSA, kid: "new", key: newKey}
+		claims := map[string]interface{}{"exp": now + 60}
+		So(serveToken(chain, "/rotate/get", oldSigner.sign(claims), nil).Code, ShouldEqual, http.StatusOK)
+		jwksBody.Store(ed25519Jwks("new", newPublic))
+		jwtMinRefreshInterval = 0
+		So(serveToken(chain, "/rotate/get", newSigner.sign(claims), nil).Code, ShouldEqual, http.StatusOK)
+		Reset(func() {
+			jwtMinRefreshInterval = 10 * time.Second
+		})
+	})
+}
+
+type memoryConsumerStore map[string]config.Consumer
+
+func (store memoryConsumerStore) GetConsumerByKeyHash(keyHash string) (config.Consumer, bool) {
+	consumer, ok := store[keyHash]
+	return consumer, ok
+}
+
+func (store memoryConsumerStore) GetConsumerByCertificate(identity string) (config.Consumer, bool) {
+	consumer, ok := store[identity]
+	return consumer, ok
+}
+
+func (store memoryConsumerStore) GetConsumerBySigningKey(keyId string) (config.Consumer, bool) {
+	consumer, ok := store[keyId]
+	return consumer, ok
+}
+
+func TestApiKey(t *testing.T) {
+	store := memoryConsumerStore{
+		HashApiKey("partner-key"): {Id: "partner", Routes: []string{"test"}, Tier: "gold"},
+		HashApiKey("admin-key"):   {Id: "admin", Routes: []string{"*"}},
+	}
+	apiKeyConfig := *proxyConfig
+	apiKeyConfig.Middleware = []config.Middleware{
+		{Name: ApiKeyName, Open: true, Params: map[string]interface{}{"routes": []string{"test", "other"}}},
+	}
+	var forwarded *http.Request
+	chain := mustNewChain(apiKeyConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+	serveKey := func(target string, header http.Header) *httptest.ResponseRecorder {
+		forwarded = nil
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		chain.ServeHTTP(w, req.WithContext(NewConsumerStoreContext(req.Context(), store)))
+		return w
+	}
+	Convey("api key middleware", t, func() {
+		Convey("key from header", func() {
+			w := serveKey("/test/get", http.Header{"X-Api-Key": {"partner-key"}, "X-Consumer-Id": {"forged"}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldEqual, "partner")
+			So(forwarded.Header.Get("X-Api-Key"), ShouldBeEmpty)
+			consumer, ok := ConsumerFrom(forwarded)
+			So(ok, ShouldBeTrue)
+			So(consumer.Tier, ShouldEqual, "gold")
+		})
+		Convey("key from query", func() {
+			w := serveKey("/test/get?api_key=partner-key&a=1", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwarded.URL.RawQuery, ShouldEqual, "a=1")
+		})
+		Convey("unknown or missing key", func() {
+			So(serveKey("/test/get", http.Header{"X-Api-Key": {"other"}}).Code, ShouldEqual, http.StatusUnauthorized)
+			So(serveKey("/test/get", nil).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("route not allowed", func() {
+			So(serveKey("/other/get", http.Header{"X-Api-Key": {"partner-key"}}).Code, ShouldEqual, http.StatusForbidden)
+			So(serveKey("/other/get", http.Header{"X-Api-Key": {"admin-key"}}).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("route without api key passes with forged consumer removed", func() {
+			w := serveKey("/public/get", http.Header{"X-Consumer-Id": {"client"}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldBeEmpty)
+		})
+	})
+}
+
+func newClientCertificate(commonName string, dnsNames []string, uris []*url.URL) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"test"}},
+		DNSNames:     dnsNames,
+		URIs:         uris,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate
+}
+
+func TestMtls(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://test/billing")
+	billingCertificate := newClientCertificate("billing", nil, []*url.URL{spiffe})
+	ordersCertificate := newClientCertificate("orders", []string{"orders.internal"}, nil)
+	pinnedCertificate := newClientCertificate("pinned", nil, nil)
+	unknownCertificate := newClientCertificate("unknown", nil, nil)
+	store := memoryConsumerStore{
+		"san:spiffe://test/billing": {Id: "billing", Routes: []string{"test"}},
+		"cn:orders":                 {Id: "orders", Routes: []string{"*"}},
+		"sha256:" + CertificateFingerprint(pinnedCertificate): {Id: "pinned", Routes: []string{"other"}},
+	}
+	mtlsConfig := *proxyConfig
+	mtlsConfig.Middleware = []config.Middleware{
+		{Name: MtlsName, Open: true, Params: map[string]interface{}{"routes": []string{"test", "other"}}},
+	}
+	var forwarded *http.Request
+	chain := mustNewChain(mtlsConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+	serveCertificate := func(target string, certificate *x509.Certificate, header http.Header) *httptest.ResponseRecorder {
+		forwarded = nil
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		if certificate != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+		}
+		chain.ServeHTTP(w, req.WithContext(NewConsumerStoreContext(req.Context(), store)))
+		return w
+	}
+	Convey("mtls middleware", t, func() {
+		Convey("san identity", func() {
+			w := serveCertificate("/test/get", billingCertificate, http.Header{"X-Consumer-Id": {"forged"}, "X-Client-Cert-Subject": {"forged"}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldEqual, "billing")
+			So(forwarded.Header.Get("X-Client-Cert-Subject"), ShouldEqual, billingCertificate.Subject.String())
+			So(forwarded.Header.Get("X-Client-Cert-San"), ShouldEqual, "spiffe://test/billing")
+			So(forwarded.Header.Get("X-Client-Cert-Fingerprint"), ShouldEqual, CertificateFingerprint(billingCertificate))
+			consumer, ok := ConsumerFrom(forwarded)
+			So(ok, ShouldBeTrue)
+			So(consumer.Id, ShouldEqual, "billing")
+		})
+		Convey("subject and fingerprint identity", func() {
+			So(serveCertificate("/other/get", ordersCertificate, nil).Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Client-Cert-San"), ShouldEqual, "orders.internal")
+			So(serveCertificate("/other/get", pinnedCertificate, nil).Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldEqual, "pinned")
 		})
+		Convey("missing or unknown certificate", func() {
+			So(serveCertificate("/test/get", nil, nil).Code, ShouldEqual, http.StatusUnauthorized)
+			So(serveCertificate("/test/get", unknownCertificate, nil).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("route not allowed", func() {
+			So(serveCertificate("/other/get", billingCertificate, nil).Code, ShouldEqual, http.StatusForbidden)
+			So(serveCertificate("/test/get", pinnedCertificate, nil).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("route without mtls strips certificate headers", func() {
+			w := serveCertificate("/public/get", nil, http.Header{"X-Client-Cert-Subject": {"forged"}, "X-Consumer-Id": {"client"}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Client-Cert-Subject"), ShouldBeEmpty)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldBeEmpty)
+		})
+	})
+}
+
+// oidcIssuer 本地模拟的oidc issuer，授权码与PKCE challenge、nonce绑定
+type oidcIssuer struct {
+	server       *httptest.Server
+	signer       jwtSigner
+	mu           sync.Mutex
+	codeMap      map[string][2]string //code -> challenge, nonce
+	refreshCount int32
+	accessToken  string //为空时返回 access-1
+}
+
+func newOidcIssuer() *oidcIssuer {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	issuer := &oidcIssuer{signer: jwtSigner{algorithm: JwtAlgorithmEdDSA, kid: "oidc", key: privateKey}, codeMap: make(map[string][2]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = jsoniter.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(ed25519Jwks("oidc", publicKey))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		claims := map[string]interface{}{
+			"iss": issuer.server.URL, "aud": "dashboard", "sub": "alice", "email": "alice@example.com",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			issuer.mu.Lock()
+			codeInfo, ok := issuer.codeMap[r.PostForm.Get("code")]
+			delete(issuer.codeMap, r.PostForm.Get("code"))
+			issuer.mu.Unlock()
+			challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != codeInfo[0] || r.PostForm.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			claims["nonce"] = codeInfo[1]
+			accessToken := "access-1"
+			issuer.mu.Lock()
+			if issuer.accessToken != "" {
+				accessToken = issuer.accessToken
+			}
+			issuer.mu.Unlock()
+			_ = jsoniter.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": accessToken, "refresh_token": "refresh-1", "expires_in": 1, "id_token": issuer.signer.sign(claims),
+			})
+		case "refresh_token":
+			if r.PostForm.Get("refresh_token") != "refresh-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			atomic.AddInt32(&issuer.refreshCount, 1)
+			claims["email"] = "alice@corp.example.com"
+			_ = jsoniter.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "access-2", "expires_in": 3600, "id_token": issuer.signer.sign(claims),
+			})
+		}
+	})
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+// authorize 模拟用户在issuer完成登录，返回回调地址
+func (issuer *oidcIssuer) authorize(location string) string {
+	authorizeUrl, _ := url.Parse(location)
+	query := authorizeUrl.Query()
+	code := randomToken()
+	issuer.mu.Lock()
+	issuer.codeMap[code] = [2]string{query.Get("code_challenge"), query.Get("nonce")}
+	issuer.mu.Unlock()
+	return query.Get("redirect_uri") + "?code=" + code + "&state=" + url.QueryEscape(query.Get("state"))
+}
+
+func TestOidc(t *testing.T) {
+	issuer := newOidcIssuer()
+	defer issuer.server.Close()
+	oidcConfig := *proxyConfig
+	oidcConfig.Middleware = []config.Middleware{{Name: OidcName, Open: true, Params: map[string]interface{}{
+		"issuer": issuer.server.URL, "client_id": "dashboard", "client_secret": "secret", "cookie_secret": "cookie-secret",
+		"routes": []string{"test"}, "access_token_header": "X-Access-Token",
+	}}}
+	var forwarded *http.Request
+	chain := mustNewChain(oidcConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+	serveCookies := func(method string, target string, cookieSlice []*http.Cookie, header http.Header) *httptest.ResponseRecorder {
+		forwarded = nil
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		for _, cookie := range cookieSlice {
+			req.AddCookie(cookie)
+		}
+		chain.ServeHTTP(w, req)
+		return w
+	}
+	responseCookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == name {
+				return cookie
+			}
+		}
+		return nil
+	}
+	Convey("oidc middleware", t, func() {
+		Convey("login, callback and refresh", func() {
+			w := serveCookies("GET", "/test/dashboard?tab=1", nil, nil)
+			So(w.Code, ShouldEqual, http.StatusFound)
+			location := w.Header().Get("Location")
+			So(location, ShouldStartWith, issuer.server.URL+"/authorize?")
+			authorizeUrl, _ := url.Parse(location)
+			So(authorizeUrl.Query().Get("code_challenge_method"), ShouldEqual, "S256")
+			So(authorizeUrl.Query().Get("redirect_uri"), ShouldEqual, "http://example.com/oauth2/callback")
+			stateCookie := responseCookie(w, "gateway_oidc_state")
+			So(stateCookie, ShouldNotBeNil)
+
+			w = serveCookies("GET", issuer.authorize(location), []*http.Cookie{stateCookie}, nil)
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(w.Header().Get("Location"), ShouldEqual, "/test/dashboard?tab=1")
+			sessionCookie := responseCookie(w, "gateway_oidc")
+			So(sessionCookie, ShouldNotBeNil)
+			So(sessionCookie.HttpOnly, ShouldBeTrue)
+
+			//access token已临近过期，使用refresh token刷新
+			w = serveCookies("GET", "/test/dashboard", []*http.Cookie{sessionCookie, {Name: "other", Value: "1"}}, http.Header{"X-Auth-Request-User": {"forged"}})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(atomic.LoadInt32(&issuer.refreshCount), ShouldEqual, 1)
+			So(forwarded.Header.Get("X-Auth-Request-User"), ShouldEqual, "alice")
+			So(forwarded.Header.Get("X-Auth-Request-Email"), ShouldEqual, "alice@corp.example.com")
+			So(forwarded.Header.Get("X-Access-Token"), ShouldEqual, "access-2")
+			So(forwarded.Header.Get("Cookie"), ShouldEqual, "other=1")
+			claims, ok := OidcClaims(forwarded)
+			So(ok, ShouldBeTrue)
+			So(claims["sub"], ShouldEqual, "alice")
+			refreshedCookie := responseCookie(w, "gateway_oidc")
+			So(refreshedCookie, ShouldNotBeNil)
+
+			w = serveCookies("GET", "/test/dashboard", []*http.Cookie{refreshedCookie}, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(atomic.LoadInt32(&issuer.refreshCount), ShouldEqual, 1)
+
+			w = serveCookies("GET", "/oauth2/logout", []*http.Cookie{refreshedCookie}, nil)
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(responseCookie(w, "gateway_oidc").MaxAge, ShouldBeLessThan, 0)
+		})
+		Convey("invalid state or session", func() {
+			w := serveCookies("GET", "/test/dashboard", nil, nil)
+			location := w.Header().Get("Location")
+			So(serveCookies("GET", issuer.authorize(location), nil, nil).Code, ShouldEqual, http.StatusBadRequest)
+			forgedState := &http.Cookie{Name: "gateway_oidc_state", Value: responseCookie(w, "gateway_oidc_state").Value + "x"}
+			So(serveCookies("GET", issuer.authorize(location), []*http.Cookie{forgedState}, nil).Code, ShouldEqual, http.StatusBadRequest)
+			So(serveCookies("GET", "/test/dashboard", []*http.Cookie{{Name: "gateway_oidc", Value: "forged"}}, nil).Code, ShouldEqual, http.StatusFound)
+			So(serveCookies("POST", "/test/dashboard", nil, nil).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("oversized session fails login", func() {
+			issuer.mu.Lock()
+			issuer.accessToken = strings.Repeat("a", oidcMaxCookieLen)
+			issuer.mu.Unlock()
+			Reset(func() {
+				issuer.mu.Lock()
+				issuer.accessToken = ""
+				issuer.mu.Unlock()
+			})
+			w := serveCookies("GET", "/test/dashboard", nil, nil)
+			stateCookie := responseCookie(w, "gateway_oidc_state")
+			w = serveCookies("GET", issuer.authorize(w.Header().Get("Location")), []*http.Cookie{stateCookie}, nil)
+			So(w.Code, ShouldEqual, http.StatusInternalServerError)
+			So(responseCookie(w, "gateway_oidc"), ShouldBeNil)
+		})
+		Convey("route without oidc", func() {
+			So(serveCookies("GET", "/public/get", nil, nil).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("safe redirect", func() {
+			So(safeRedirect("//evil.example.com/"), ShouldEqual, "/")
+			So(safeRedirect("https://evil.example.com/"), ShouldEqual, "/")
+			So(safeRedirect("/test/get?a=1"), ShouldEqual, "/test/get?a=1")
+		})
+	})
+}
+
+func TestHmac(t *testing.T) {
+	webhook := config.Consumer{Id: "webhook", Routes: []string{"test"}, SigningKeys: map[string]string{"key-1": "secret-1"}}
+	blank := config.Consumer{Id: "blank", Routes: []string{"test"}, SigningKeys: map[string]string{"key-blank": ""}}
+	store := memoryConsumerStore{"key-1": webhook, "key-blank": blank}
+	hmacConfig := *proxyConfig
+	hmacConfig.Middleware = []config.Middleware{{Name: HmacName, Open: true, Params: map[string]interface{}{
+		"routes": []string{"test", "other"}, "signed_headers": []string{"Host", "Content-Type"}, "max_skew": 60, "max_body_size": 64,
+	}}}
+	var forwardedBody string
+	var forwarded *http.Request
+	chain := mustNewChain(hmacConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		body, _ := ioutil.ReadAll(r.Body)
+		forwardedBody = string(body)
+	}))
+	newSignedRequest := func(target string, body string, nonce string, now time.Time) *http.Request {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		SignRequest(req, []byte(body), "key-1", "secret-1", nonce, []string{"host", "content-type"}, now)
+		return req
+	}
+	serveSigned := func(req *http.Request) *httptest.ResponseRecorder {
+		forwarded = nil
+		w := httptest.NewRecorder()
+		chain.ServeHTTP(w, req.WithContext(NewConsumerStoreContext(req.Context(), store)))
+		return w
+	}
+	Convey("hmac middleware", t, func() {
+		Convey("valid signature", func() {
+			req := newSignedRequest("/test/hook?b=2&a=1", `{"event":"paid"}`, "nonce-1", time.Now())
+			req.Header.Set("X-Consumer-Id", "forged")
+			w := serveSigned(req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(forwardedBody, ShouldEqual, `{"event":"paid"}`)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldEqual, "webhook")
+			consumer, ok := ConsumerFrom(forwarded)
+			So(ok, ShouldBeTrue)
+			So(consumer.Id, ShouldEqual, "webhook")
+		})
+		Convey("blank signing key rejected", func() {
+			req := httptest.NewRequest("POST", "/test/hook", strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			SignRequest(req, []byte("{}"), "key-blank", "", "nonce-blank", []string{"host", "content-type"}, time.Now())
+			So(serveSigned(req).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("replayed nonce", func() {
+			So(serveSigned(newSignedRequest("/test/hook", "{}", "nonce-2", time.Now())).Code, ShouldEqual, http.StatusOK)
+			So(serveSigned(newSignedRequest("/test/hook", "{}", "nonce-2", time.Now())).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("tampered request", func() {
+			req := newSignedRequest("/test/hook", `{"amount":1}`, "nonce-3", time.Now())
+			req.Body = ioutil.NopCloser(strings.NewReader(`{"amount":100}`))
+			So(serveSigned(req).Code, ShouldEqual, http.StatusUnauthorized)
+			req = newSignedRequest("/test/hook?a=1", "{}", "nonce-4", time.Now())
+			req.URL.RawQuery = "a=2"
+			So(serveSigned(req).Code, ShouldEqual, http.StatusUnauthorized)
+			req = newSignedRequest("/test/hook", "{}", "nonce-5", time.Now())
+			req.Header.Set("Content-Type", "text/plain")
+			So(serveSigned(req).Code, ShouldEqual, http.StatusUnauthorized)
+			//篡改签名失败的nonce不会被记录
+			So(serveSigned(newSignedRequest("/test/hook", "{}", "nonce-5", time.Now())).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("timestamp out of range", func() {
+			So(serveSigned(newSignedRequest("/test/hook", "{}", "nonce-6", time.Now().Add(-2*time.Minute))).Code, ShouldEqual, http.StatusUnauthorized)
+			So(serveSigned(newSignedRequest("/test/hook", "{}", "nonce-7", time.Now().Add(2*time.Minute))).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("unknown key, missing signature and body limit", func() {
+			req := httptest.NewRequest("POST", "/test/hook", strings.NewReader("{}"))
+			SignRequest(req, []byte("{}"), "key-2", "secret-1", "nonce-8", nil, time.Now())
+			So(serveSigned(req).Code, ShouldEqual, http.StatusUnauthorized)
+			So(serveSigned(httptest.NewRequest("POST", "/test/hook", nil)).Code, ShouldEqual, http.StatusUnauthorized)
+			So(serveSigned(newSignedRequest("/test/hook", strings.Repeat("a", 65), "nonce-9", time.Now())).Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		})
+		Convey("route not allowed", func() {
+			So(serveSigned(newSignedRequest("/other/hook", "{}", "nonce-10", time.Now())).Code, ShouldEqual, http.StatusForbidden)
+			req := httptest.NewRequest("GET", "/public/get", nil)
+			req.Header.Set("X-Consumer-Id", "forged")
+			So(serveSigned(req).Code, ShouldEqual, http.StatusOK)
+			So(forwarded.Header.Get("X-Consumer-Id"), ShouldBeEmpty)
+		})
+	})
+}
+
+type serviceResolverFunc func(r *http.Request) string
+
+func (f serviceResolverFunc) ResolveService(r *http.Request) string {
+	return f(r)
+}
+
+func TestConcurrency(t *testing.T) {
+	Convey("aimd limiter", t, func() {
+		params := defaultConcurrencyParams
+		params.InitialLimit = 4
+		params.MaxLimit = 6
+		now := time.Now()
+		limiter := newAimdLimiter(&params, now)
+		Convey("increase while saturated and healthy", func() {
+			for i := 0; i < 40; i++ {
+				inflight, ok := limiter.acquire()
+				So(ok, ShouldBeTrue)
+				limiter.release(10*time.Millisecond, false, inflight+2, now)
+			}
+			So(limiter.currentLimit(), ShouldEqual, 6)
+		})
+		Convey("decrease on overload status or latency", func() {
+			inflight, _ := limiter.acquire()
+			limiter.release(10*time.Millisecond, false, inflight, now)
+			inflight, _ = limiter.acquire()
+			limiter.release(10*time.Millisecond, true, inflight, now)
+			So(limiter.currentLimit(), ShouldEqual, 3)
+			inflight, _ = limiter.acquire()
+			limiter.release(50*time.Millisecond, false, inflight, now)
+			So(limiter.currentLimit(), ShouldEqual, 3)
+			for i := 0; i < 20; i++ {
+				inflight, _ = limiter.acquire()
+				limiter.release(50*time.Millisecond, false, inflight, now)
+			}
+			So(limiter.currentLimit(), ShouldEqual, params.MinLimit)
+		})
+		Convey("min rtt resets each window", func() {
+			inflight, _ := limiter.acquire()
+			limiter.release(10*time.Millisecond, false, inflight, now)
+			inflight, _ = limiter.acquire()
+			limiter.release(15*time.Millisecond, false, inflight, now.Add(31*time.Second))
+			So(limiter.minRtt, ShouldEqual, 10*time.Millisecond)
+			inflight, _ = limiter.acquire()
+			limiter.release(15*time.Millisecond, false, inflight, now.Add(62*time.Second))
+			So(limiter.minRtt, ShouldEqual, 15*time.Millisecond)
+		})
+	})
+	Convey("limiters keyed by resolved service", t, func() {
+		concurrencyConfig := *proxyConfig
+		concurrencyConfig.ReverseHost = []config.ReverseHost{{ServiceName: "test"}, {ServiceName: "orders"}}
+		limit, err := newConcurrencyLimit(concurrencyConfig, nil)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		resolve := func(path string, serviceName string) *http.Request {
+			req := httptest.NewRequest("GET", path, nil)
+			return req.WithContext(NewServiceResolverContext(req.Context(), serviceResolverFunc(func(r *http.Request) string {
+				return serviceName
+			})))
+		}
+		baseline := limit.limiter(resolve("/test/get", "test"), "test", now)
+		canary := limit.limiter(resolve("/test/get", "test-canary"), "test", now)
+		So(canary, ShouldNotEqual, baseline)
+		So(limit.limiter(httptest.NewRequest("GET", "/test/get", nil), "test", now), ShouldEqual, baseline)
+		//路由名与服务名相同时不会共用
+		So(limit.limiter(resolve("/orders/get", "orders-v2"), "orders", now), ShouldNotEqual, limit.limiter(resolve("/orders-v2/get", "orders-v2"), "orders-v2", now))
+		So(limit.limiter(resolve("/random-1/get", "random-1"), "random-1", now), ShouldEqual, limit.defaultLimiter)
+		So(limit.limiter(resolve("/random-2/get", "random-2"), "random-2", now), ShouldEqual, limit.defaultLimiter)
+		So(limit.limiterStore.len(), ShouldEqual, 3)
+	})
+	Convey("local rejection does not shrink limit", t, func() {
+		concurrencyConfig := *proxyConfig
+		concurrencyConfig.ReverseHost = []config.ReverseHost{{ServiceName: "test"}}
+		limit, err := newConcurrencyLimit(concurrencyConfig, map[string]interface{}{"initial_limit": 10})
+		So(err, ShouldBeNil)
+		upstreamStatus := http.StatusOK
+		handler := limit.handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if upstreamStatus == http.StatusOK {
+				Reject(w, r, &LimitError{Code: http.StatusServiceUnavailable, Msg: "shed"})
+				return
+			}
+			w.WriteHeader(upstreamStatus)
+		}))
+		limiter := limit.limiter(httptest.NewRequest("GET", "/test/get", nil), "test", time.Now())
+		for i := 0; i < 5; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/test/get", nil))
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		}
+		So(limiter.currentLimit(), ShouldEqual, 10)
+		upstreamStatus = http.StatusServiceUnavailable
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/get", nil))
+		So(limiter.currentLimit(), ShouldEqual, 9)
+	})
+	Convey("concurrency middleware", t, func() {
+		concurrencyConfig := *proxyConfig
+		concurrencyConfig.Middleware = []config.Middleware{{Name: ConcurrencyName, Open: true, Params: map[string]interface{}{
+			"initial_limit": 1, "routes": []string{"test"},
+		}}}
+		release := make(chan struct{})
+		entered := make(chan struct{}, 1)
+		chain := mustNewChain(concurrencyConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/test/slow" {
+				entered <- struct{}{}
+				<-release
+			}
+		}))
+		done := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			chain.ServeHTTP(w, httptest.NewRequest("GET", "/test/slow", nil))
+			done <- w.Code
+		}()
+		<-entered
+		w := httptest.NewRecorder()
+		chain.ServeHTTP(w, httptest.NewRequest("GET", "/test/get", nil))
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		So(w.Header().Get("Retry-After"), ShouldEqual, "1")
+		w = httptest.NewRecorder()
+		chain.ServeHTTP(w, httptest.NewRequest("GET", "/other/get", nil))
+		So(w.Code, ShouldEqual, http.StatusOK)
+		close(release)
+		So(<-done, ShouldEqual, http.StatusOK)
+		w = httptest.NewRecorder()
+		chain.ServeHTTP(w, httptest.NewRequest("GET", "/test/get", nil))
+		So(w.Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestLoadShed(t *testing.T) {
+	shedConfig := *proxyConfig
+	shedConfig.Restrictor.Queue = config.RestrictorQueue{Classes: []config.RestrictorQueueClass{
+		{Name: "checkout", Routes: []string{"checkout"}},
+		{Name: "export", Headers: map[string]string{"X-Export": ""}},
+	}}
+	serveTarget := func(chain http.Handler, target string, header string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", target, nil)
+		if header != "" {
+			req.Header.Set(header, "1")
+		}
+		chain.ServeHTTP(w, req)
+		return w.Code
+	}
+	Convey("shed by inflight", t, func() {
+		shedConfig.Middleware = []config.Middleware{{Name: LoadShedName, Open: true, Params: map[string]interface{}{
+			"max_inflight": 1, "keep_classes": []string{"checkout"},
+		}}}
+		release := make(chan struct{})
+		entered := make(chan struct{}, 1)
+		chain := mustNewChain(shedConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/test/slow" {
+				entered <- struct{}{}
+				<-release
+			}
+		}))
+		done := make(chan int)
+		go func() {
+			done <- serveTarget(chain, "/test/slow", "")
+		}()
+		<-entered
+		So(serveTarget(chain, "/test/get", ""), ShouldEqual, http.StatusServiceUnavailable)
+		So(serveTarget(chain, "/test/get", "X-Export"), ShouldEqual, http.StatusServiceUnavailable)
+		So(serveTarget(chain, "/checkout/pay", ""), ShouldEqual, http.StatusOK)
+		close(release)
+		So(<-done, ShouldEqual, http.StatusOK)
+		So(serveTarget(chain, "/test/get", ""), ShouldEqual, http.StatusOK)
+	})
+	Convey("shed by goroutines and keep configured classes", t, func() {
+		shedConfig.Middleware = []config.Middleware{{Name: LoadShedName, Open: true, Params: map[string]interface{}{
+			"max_goroutines": 1,
+		}}}
+		chain := mustNewChain(shedConfig, okHandler)
+		So(serveTarget(chain, "/test/get", ""), ShouldEqual, http.StatusServiceUnavailable)
+		So(serveTarget(chain, "/test/get", "X-Export"), ShouldEqual, http.StatusOK)
+		So(serveTarget(chain, "/checkout/pay", ""), ShouldEqual, http.StatusOK)
+	})
+	Convey("health monitor", t, func() {
+		monitor := newHealthMonitor(time.Minute)
+		now := time.Now()
+		health := monitor.sample(now)
+		So(health.goroutines, ShouldBeGreaterThan, 0)
+		So(health.heapBytes, ShouldBeGreaterThan, 0)
+		//采样间隔内沿用上次结果
+		So(monitor.sample(now.Add(time.Second)), ShouldResemble, health)
+	})
+	Convey("histogram percentile", t, func() {
+		buckets := []float64{0, 0.001, 0.01, 0.1, 1}
+		before := []uint64{10, 0, 0, 0}
+		So(histogramPercentile(buckets, []uint64{10, 0, 0, 0}, before, 0.99), ShouldEqual, 0)
+		So(histogramPercentile(buckets, []uint64{60, 40, 0, 0}, before, 0.99), ShouldEqual, time.Millisecond)
+		So(histogramPercentile(buckets, []uint64{20, 80, 0, 10}, before, 0.99), ShouldEqual, 100*time.Millisecond)
 	})
 }
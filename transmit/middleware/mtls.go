@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"simple_proxygateway/config"
+)
+
+// CertificateConsumerStore 按客户端证书标识查询接入方，由 etcd.LocalCache 实现
+type CertificateConsumerStore interface {
+	GetConsumerByCertificate(identity string) (config.Consumer, bool)
+}
+
+type (
+	mtlsParams struct {
+		Routes            []string `yaml:"routes"`             //需要客户端证书的路由，为空时全部路由
+		SubjectHeader     string   `yaml:"subject_header"`     //默认X-Client-Cert-Subject
+		FingerprintHeader string   `yaml:"fingerprint_header"` //默认X-Client-Cert-Fingerprint
+		SanHeader         string   `yaml:"san_header"`         //默认X-Client-Cert-San，多个以,分隔
+		ConsumerHeader    string   `yaml:"consumer_header"`    //默认X-Consumer-Id
+	}
+	mtlsAuth struct {
+		params   mtlsParams
+		routeMap map[string]struct{}
+	}
+)
+
+const (
+	defaultMtlsSubjectHeader     = "X-Client-Cert-Subject"
+	defaultMtlsFingerprintHeader = "X-Client-Cert-Fingerprint"
+	defaultMtlsSanHeader         = "X-Client-Cert-San"
+)
+
+func buildMtlsHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	auth := mtlsAuth{routeMap: make(map[string]struct{})}
+	if err := DecodeParams(params, &auth.params); err != nil {
+		return nil, err
+	}
+	if auth.params.SubjectHeader == "" {
+		auth.params.SubjectHeader = defaultMtlsSubjectHeader
+	}
+	if auth.params.FingerprintHeader == "" {
+		auth.params.FingerprintHeader = defaultMtlsFingerprintHeader
+	}
+	if auth.params.SanHeader == "" {
+		auth.params.SanHeader = defaultMtlsSanHeader
+	}
+	if auth.params.ConsumerHeader == "" {
+		auth.params.ConsumerHeader = defaultApiKeyConsumerHeader
+	}
+	for _, route := range auth.params.Routes {
+		auth.routeMap[route] = struct{}{}
+	}
+	return MiddlewareFunc(auth.handle), nil
+}
+
+func (auth mtlsAuth) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//证书信息仅由网关写入，移除客户端伪造的同名header
+		r.Header.Del(auth.params.SubjectHeader)
+		r.Header.Del(auth.params.FingerprintHeader)
+		r.Header.Del(auth.params.SanHeader)
+		stripConsumerHeader(r, auth.params.ConsumerHeader)
+		routeName := RouteName(r.URL.Path)
+		if _, ok := auth.routeMap[routeName]; len(auth.routeMap) > 0 && !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(auth.params.ConsumerHeader)
+		//仅信任握手时已通过CA校验的证书
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: "client certificate required"})
+			return
+		}
+		store, ok := consumerStoreFrom(r)
+		certificateStore, isCertificateStore := store.(CertificateConsumerStore)
+		if !ok || !isCertificateStore {
+			Reject(w, r, &LimitError{Code: http.StatusServiceUnavailable, Msg: "consumer store unavailable"})
+			return
+		}
+		certificate := r.TLS.VerifiedChains[0][0]
+		var consumer config.Consumer
+		found := false
+		for _, identity := range CertificateIdentities(certificate) {
+			if consumer, found = certificateStore.GetConsumerByCertificate(identity); found {
+				break
+			}
+		}
+		if !found {
+			Reject(w, r, &LimitError{Code: ForbiddenErr.Code, Msg: "unknown client certificate"})
+			return
+		}
+		if !consumer.AllowRoute(routeName) {
+			Reject(w, r, &LimitError{Code: ForbiddenErr.Code, Msg: "route not allowed"})
+			return
+		}
+		r.Header.Set(auth.params.SubjectHeader, certificate.Subject.String())
+		r.Header.Set(auth.params.FingerprintHeader, CertificateFingerprint(certificate))
+		if sanSlice := certificateSans(certificate); len(sanSlice) > 0 {
+			r.Header.Set(auth.params.SanHeader, strings.Join(sanSlice, ","))
+		}
+		r.Header.Set(auth.params.ConsumerHeader, consumer.Id)
+		next.ServeHTTP(w, WithConsumer(r, consumer))
+	})
+}
+
+// CertificateFingerprint 证书DER编码的sha256摘要(hex)
+func CertificateFingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificateIdentities 证书可映射至接入方的标识，按 sha256:指纹、san:名称、cn:名称 的顺序匹配
+func CertificateIdentities(certificate *x509.Certificate) []string {
+	identitySlice := []string{"sha256:" + CertificateFingerprint(certificate)}
+	for _, san := range certificateSans(certificate) {
+		identitySlice = append(identitySlice, "san:"+san)
+	}
+	if certificate.Subject.CommonName != "" {
+		identitySlice = append(identitySlice, "cn:"+certificate.Subject.CommonName)
+	}
+	return identitySlice
+}
+
+func certificateSans(certificate *x509.Certificate) []string {
+	sanSlice := make([]string, 0, len(certificate.DNSNames)+len(certificate.URIs))
+	sanSlice = append(sanSlice, certificate.DNSNames...)
+	for _, uri := range certificate.URIs {
+		sanSlice = append(sanSlice, uri.String())
+	}
+	sanSlice = append(sanSlice, certificate.EmailAddresses...)
+	for _, ip := range certificate.IPAddresses {
+		sanSlice = append(sanSlice, ip.String())
+	}
+	return sanSlice
+}
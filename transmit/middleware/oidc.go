@@ -0,0 +1,550 @@
+package middleware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/logger"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+type (
+	oidcParams struct {
+		Issuer       string   `yaml:"issuer"`
+		ClientId     string   `yaml:"client_id"`
+		ClientSecret string   `yaml:"client_secret"`
+		Scopes       []string `yaml:"scopes"`        //默认 openid profile email
+		RedirectUrl  string   `yaml:"redirect_url"`  //回调完整地址，为空时按请求host及callback_path生成
+		CallbackPath string   `yaml:"callback_path"` //默认/oauth2/callback
+		LogoutPath   string   `yaml:"logout_path"`   //默认/oauth2/logout
+		Routes       []string `yaml:"routes"`        //需要登录的路由，为空时全部路由
+		CookieName   string   `yaml:"cookie_name"`   //默认gateway_oidc
+		CookieSecret string   `yaml:"cookie_secret"` //会话cookie加密密钥，多实例需保持一致
+		SessionTtl   int      `yaml:"session_ttl"`   //会话有效期(秒)，默认86400，刷新token不会延长
+		//转发至上游的claim，claim名称 -> header名称，默认 sub -> X-Auth-Request-User，email -> X-Auth-Request-Email
+		ClaimHeaders map[string]string `yaml:"claim_headers"`
+		//转发access token的header，为空时不转发也不保存至cookie
+		AccessTokenHeader string `yaml:"access_token_header"`
+	}
+	oidcProvider struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+		idTokenVerifier       *jwtRoute
+	}
+	oidcAuth struct {
+		params       oidcParams
+		routeMap     map[string]struct{}
+		aead         cipher.AEAD
+		mu           sync.Mutex
+		provider     *oidcProvider
+		discoverTime time.Time
+		discoverErr  error
+	}
+	// oidcSession 加密保存于cookie，仅保存claim_headers及sub
+	oidcSession struct {
+		Claims           map[string]interface{} `json:"claims"`
+		AccessToken      string                 `json:"access_token,omitempty"`
+		RefreshToken     string                 `json:"refresh_token,omitempty"`
+		ExpiresAt        int64                  `json:"expires_at,omitempty"` //access token过期时间，0为未返回expires_in
+		SessionExpiresAt int64                  `json:"session_expires_at"`
+	}
+	// oidcLoginState 跳转登录时保存于cookie，回调时校验state并取出PKCE verifier
+	oidcLoginState struct {
+		State     string `json:"state"`
+		Verifier  string `json:"verifier"`
+		Nonce     string `json:"nonce"`
+		Redirect  string `json:"redirect"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	oidcTokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		RefreshToken     string `json:"refresh_token"`
+		IdToken          string `json:"id_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	oidcClaimsKey struct{}
+)
+
+var (
+	defaultOidcScopes       = []string{"openid", "profile", "email"}
+	defaultOidcClaimHeaders = map[string]string{"sub": "X-Auth-Request-User", "email": "X-Auth-Request-Email"}
+	defaultOidcSessionTtl   = 86400
+	oidcLoginTimeout        = 10 * time.Minute
+	// access token到期前提前刷新的时间(秒)
+	oidcRefreshSkew  int64 = 30
+	oidcLeeway             = 60
+	oidcMaxCookieLen       = 4096
+	oidcHttpClient         = &http.Client{Timeout: 5 * time.Second}
+
+	oidcCookieErr         = errors.New("session cookie invalid")
+	oidcProviderErr       = errors.New("oidc provider config invalid")
+	oidcNonceErr          = errors.New("id token nonce invalid")
+	oidcCookieTooLargeErr = errors.New("session cookie too large")
+)
+
+const (
+	defaultOidcCallbackPath = "/oauth2/callback"
+	defaultOidcLogoutPath   = "/oauth2/logout"
+	defaultOidcCookieName   = "gateway_oidc"
+)
+
+func buildOidcHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	auth := &oidcAuth{routeMap: make(map[string]struct{})}
+	if err := DecodeParams(params, &auth.params); err != nil {
+		return nil, err
+	}
+	if len(auth.params.Scopes) == 0 {
+		auth.params.Scopes = defaultOidcScopes
+	}
+	if auth.params.CallbackPath == "" {
+		auth.params.CallbackPath = defaultOidcCallbackPath
+	}
+	if auth.params.LogoutPath == "" {
+		auth.params.LogoutPath = defaultOidcLogoutPath
+	}
+	if auth.params.CookieName == "" {
+		auth.params.CookieName = defaultOidcCookieName
+	}
+	if auth.params.SessionTtl <= 0 {
+		auth.params.SessionTtl = defaultOidcSessionTtl
+	}
+	if auth.params.ClaimHeaders == nil {
+		auth.params.ClaimHeaders = defaultOidcClaimHeaders
+	}
+	for _, route := range auth.params.Routes {
+		auth.routeMap[route] = struct{}{}
+	}
+	secret := []byte(auth.params.CookieSecret)
+	if len(secret) == 0 {
+		//未配置密钥时随机生成，重启或多实例部署时需重新登录
+		secret = make([]byte, 32)
+		_, _ = rand.Read(secret)
+		logger.Runtime.Warn("oidc cookie secret not set, sessions will not be shared between gateways")
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if auth.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return MiddlewareFunc(auth.handle), nil
+}
+
+func (auth *oidcAuth) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case auth.params.CallbackPath:
+			auth.callback(w, r)
+			return
+		case auth.params.LogoutPath:
+			http.SetCookie(w, auth.cookie(r, auth.params.CookieName, "", -1))
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		if _, ok := auth.routeMap[RouteName(r.URL.Path)]; len(auth.routeMap) > 0 && !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, header := range auth.params.ClaimHeaders {
+			r.Header.Del(header)
+		}
+		if auth.params.AccessTokenHeader != "" {
+			r.Header.Del(auth.params.AccessTokenHeader)
+		}
+		now := time.Now()
+		session, ok := auth.readSession(r, now)
+		if ok && session.ExpiresAt > 0 && now.Unix()+oidcRefreshSkew >= session.ExpiresAt {
+			if refreshed, err := auth.refresh(r.Context(), session, now); err == nil {
+				session = refreshed
+				if err = auth.writeSession(w, r, session); err != nil {
+					//本次请求使用刷新后的token，原cookie保留，下次请求重新刷新
+					logger.Runtime.Error("oidc session err:" + err.Error())
+				}
+			} else if now.Unix() >= session.ExpiresAt {
+				logger.Runtime.Error("oidc refresh token err:" + err.Error())
+				ok = false
+			}
+		}
+		if !ok {
+			auth.login(w, r, now)
+			return
+		}
+		for claim, header := range auth.params.ClaimHeaders {
+			if value, ok := session.Claims[claim]; ok {
+				r.Header.Set(header, claimString(value))
+			}
+		}
+		if auth.params.AccessTokenHeader != "" && session.AccessToken != "" {
+			r.Header.Set(auth.params.AccessTokenHeader, session.AccessToken)
+		}
+		//会话cookie不透传至上游
+		removeCookies(r, auth.params.CookieName, auth.stateCookieName())
+		ctx := context.WithValue(r.Context(), oidcClaimsKey{}, session.Claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// OidcClaims 已登录用户的claims，仅包含 claim_headers 中的claim及sub
+func OidcClaims(r *http.Request) (map[string]interface{}, bool) {
+	claims, ok := r.Context().Value(oidcClaimsKey{}).(map[string]interface{})
+	return claims, ok
+}
+
+// login 生成state、nonce及PKCE verifier后跳转至issuer登录，非GET请求直接返回401
+func (auth *oidcAuth) login(w http.ResponseWriter, r *http.Request, now time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: "login required"})
+		return
+	}
+	provider, err := auth.getProvider(now)
+	if err != nil {
+		Reject(w, r, &LimitError{Code: http.StatusServiceUnavailable, Msg: "oidc provider unavailable"})
+		return
+	}
+	loginState := oidcLoginState{
+		State:     randomToken(),
+		Verifier:  randomToken(),
+		Nonce:     randomToken(),
+		Redirect:  r.URL.RequestURI(),
+		ExpiresAt: now.Add(oidcLoginTimeout).Unix(),
+	}
+	value, err := auth.seal(auth.stateCookieName(), loginState)
+	if err != nil {
+		Reject(w, r, &LimitError{Code: http.StatusInternalServerError, Msg: "login state error"})
+		return
+	}
+	http.SetCookie(w, auth.cookie(r, auth.stateCookieName(), value, int(oidcLoginTimeout/time.Second)))
+	challenge := sha256.Sum256([]byte(loginState.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {auth.params.ClientId},
+		"redirect_uri":          {auth.redirectUrl(r)},
+		"scope":                 {strings.Join(auth.params.Scopes, " ")},
+		"state":                 {loginState.State},
+		"nonce":                 {loginState.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// callback 校验state后以授权码及PKCE verifier换取token，校验id token后写入会话并跳回原地址
+func (auth *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	loginState := oidcLoginState{}
+	cookie, err := r.Cookie(auth.stateCookieName())
+	if err == nil {
+		err = auth.open(auth.stateCookieName(), cookie.Value, &loginState)
+	}
+	state := r.URL.Query().Get("state")
+	if err != nil || now.Unix() > loginState.ExpiresAt || state == "" ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(loginState.State)) != 1 {
+		Reject(w, r, &LimitError{Code: http.StatusBadRequest, Msg: "invalid login state"})
+		return
+	}
+	http.SetCookie(w, auth.cookie(r, auth.stateCookieName(), "", -1))
+	if loginErr := r.URL.Query().Get("error"); loginErr != "" {
+		Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: "login failed:" + loginErr})
+		return
+	}
+	provider, err := auth.getProvider(now)
+	if err != nil {
+		Reject(w, r, &LimitError{Code: http.StatusServiceUnavailable, Msg: "oidc provider unavailable"})
+		return
+	}
+	token, err := auth.requestToken(r.Context(), provider, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {auth.redirectUrl(r)},
+		"code_verifier": {loginState.Verifier},
+	})
+	if err != nil {
+		logger.Runtime.Error("oidc token exchange err:" + err.Error())
+		Reject(w, r, &LimitError{Code: http.StatusBadGateway, Msg: "token exchange failed"})
+		return
+	}
+	claims, err := provider.idTokenVerifier.verify(token.IdToken, now)
+	if err == nil {
+		if nonce, _ := claims["nonce"].(string); nonce != loginState.Nonce {
+			err = oidcNonceErr
+		}
+	}
+	if err != nil {
+		Reject(w, r, &LimitError{Code: UnauthorizedErr.Code, Msg: "id token invalid"})
+		return
+	}
+	session := auth.newSession(token, claims, now)
+	session.SessionExpiresAt = now.Add(time.Duration(auth.params.SessionTtl) * time.Second).Unix()
+	if err = auth.writeSession(w, r, session); err != nil {
+		//cookie超长时浏览器会丢弃，直接报错避免反复跳转登录
+		logger.Runtime.Error("oidc session err:" + err.Error())
+		Reject(w, r, &LimitError{Code: http.StatusInternalServerError, Msg: "login session too large, reduce claim_headers or access_token_header"})
+		return
+	}
+	http.Redirect(w, r, safeRedirect(loginState.Redirect), http.StatusFound)
+}
+
+// refresh 使用refresh token换取新的access token，返回新的id token时同时更新claims
+func (auth *oidcAuth) refresh(ctx context.Context, session oidcSession, now time.Time) (oidcSession, error) {
+	if session.RefreshToken == "" {
+		return session, errors.New("refresh token missing")
+	}
+	provider, err := auth.getProvider(now)
+	if err != nil {
+		return session, err
+	}
+	token, err := auth.requestToken(ctx, provider, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		return session, err
+	}
+	claims := session.Claims
+	if token.IdToken != "" {
+		if claims, err = provider.idTokenVerifier.verify(token.IdToken, now); err != nil {
+			return session, err
+		}
+	}
+	refreshed := auth.newSession(token, claims, now)
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = session.RefreshToken
+	}
+	refreshed.SessionExpiresAt = session.SessionExpiresAt
+	return refreshed, nil
+}
+
+func (auth *oidcAuth) newSession(token oidcTokenResponse, claims map[string]interface{}, now time.Time) oidcSession {
+	session := oidcSession{Claims: make(map[string]interface{}), RefreshToken: token.RefreshToken}
+	for claim := range auth.params.ClaimHeaders {
+		if value, ok := claims[claim]; ok {
+			session.Claims[claim] = value
+		}
+	}
+	if sub, ok := claims["sub"]; ok {
+		session.Claims["sub"] = sub
+	}
+	if auth.params.AccessTokenHeader != "" {
+		session.AccessToken = token.AccessToken
+	}
+	if token.ExpiresIn > 0 {
+		session.ExpiresAt = now.Unix() + token.ExpiresIn
+	}
+	return session
+}
+
+func (auth *oidcAuth) requestToken(ctx context.Context, provider *oidcProvider, form url.Values) (oidcTokenResponse, error) {
+	token := oidcTokenResponse{}
+	form.Set("client_id", auth.params.ClientId)
+	if auth.params.ClientSecret != "" {
+		form.Set("client_secret", auth.params.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHttpClient.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return token, err
+	}
+	if err = jsoniter.Unmarshal(body, &token); err != nil {
+		return token, err
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return token, fmt.Errorf("token endpoint status:%d error:%s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	return token, nil
+}
+
+// getProvider 首次使用时读取issuer的discovery配置，失败后按最小间隔重试
+func (auth *oidcAuth) getProvider(now time.Time) (*oidcProvider, error) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if auth.provider != nil {
+		return auth.provider, nil
+	}
+	if auth.discoverErr != nil && now.Sub(auth.discoverTime) < jwtMinRefreshInterval {
+		return nil, auth.discoverErr
+	}
+	auth.discoverTime = now
+	auth.provider, auth.discoverErr = discoverOidcProvider(auth.params)
+	if auth.discoverErr != nil {
+		logger.Runtime.Error("oidc discovery err:" + auth.discoverErr.Error())
+	}
+	return auth.provider, auth.discoverErr
+}
+
+func discoverOidcProvider(params oidcParams) (*oidcProvider, error) {
+	if params.Issuer == "" || params.ClientId == "" {
+		return nil, fmt.Errorf("%w: issuer and client_id required", oidcProviderErr)
+	}
+	resp, err := oidcHttpClient.Get(strings.TrimSuffix(params.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status:%d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	provider := &oidcProvider{}
+	if err = jsoniter.Unmarshal(body, provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != params.Issuer || provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksUri == "" {
+		return nil, fmt.Errorf("%w: issuer %s", oidcProviderErr, provider.Issuer)
+	}
+	provider.idTokenVerifier = newJwtRoute(config.Jwt{
+		Issuer:     params.Issuer,
+		Audience:   []string{params.ClientId},
+		Algorithms: []string{JwtAlgorithmRS256, JwtAlgorithmES256, JwtAlgorithmEdDSA},
+		Leeway:     oidcLeeway,
+		JwksUrl:    provider.JwksUri,
+	})
+	return provider, nil
+}
+
+func (auth *oidcAuth) readSession(r *http.Request, now time.Time) (oidcSession, bool) {
+	session := oidcSession{}
+	cookie, err := r.Cookie(auth.params.CookieName)
+	if err != nil || auth.open(auth.params.CookieName, cookie.Value, &session) != nil || now.Unix() >= session.SessionExpiresAt {
+		return session, false
+	}
+	return session, true
+}
+
+// writeSession 超出浏览器cookie长度限制时返回错误，不写入会被浏览器丢弃的cookie
+func (auth *oidcAuth) writeSession(w http.ResponseWriter, r *http.Request, session oidcSession) error {
+	value, err := auth.seal(auth.params.CookieName, session)
+	if err != nil {
+		return err
+	}
+	if len(auth.params.CookieName)+len(value)+1 > oidcMaxCookieLen {
+		return fmt.Errorf("%w:%d", oidcCookieTooLargeErr, len(value))
+	}
+	maxAge := int(session.SessionExpiresAt - time.Now().Unix())
+	http.SetCookie(w, auth.cookie(r, auth.params.CookieName, value, maxAge))
+	return nil
+}
+
+// seal 以AES-GCM加密，cookie名称作为附加数据，避免不同cookie的值互相替换
+func (auth *oidcAuth) seal(name string, value interface{}) (string, error) {
+	plaintext, err := jsoniter.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, auth.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(auth.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+func (auth *oidcAuth) open(name string, value string, out interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < auth.aead.NonceSize() {
+		return oidcCookieErr
+	}
+	nonceSize := auth.aead.NonceSize()
+	plaintext, err := auth.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return oidcCookieErr
+	}
+	return jsoniter.Unmarshal(plaintext, out)
+}
+
+func (auth *oidcAuth) stateCookieName() string {
+	return auth.params.CookieName + "_state"
+}
+
+func (auth *oidcAuth) cookie(r *http.Request, name string, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (auth *oidcAuth) redirectUrl(r *http.Request) string {
+	if auth.params.RedirectUrl != "" {
+		return auth.params.RedirectUrl
+	}
+	return requestScheme(r) + "://" + r.Host + auth.params.CallbackPath
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// safeRedirect 仅允许跳转至本站路径
+func safeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+func removeCookies(r *http.Request, names ...string) {
+	cookieSlice := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookieSlice {
+		removed := false
+		for _, name := range names {
+			if cookie.Name == name {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func randomToken() string {
+	token := make([]byte, 32)
+	_, _ = rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
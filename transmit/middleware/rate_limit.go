@@ -0,0 +1,296 @@
+package middleware
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"simple_proxygateway/config"
+
+	"golang.org/x/time/rate"
+)
+
+type (
+	// limitBucket 单个限流key的限流状态，share 为集群限流时限额的均分数
+	limitBucket interface {
+		take(ctx context.Context, now time.Time, share int, class *admissionClass) rateLimitStatus
+	}
+	// rateLimitStatus 本次请求后的额度，多个窗口时为最接近耗尽的窗口
+	rateLimitStatus struct {
+		allowed    bool
+		limit      int
+		remaining  int
+		reset      int //额度恢复所需秒数
+		retryAfter int //被限流时建议的重试间隔(秒)
+	}
+	// tokenBucket 令牌桶，令牌不足时按排队等级等待
+	tokenBucket struct {
+		mu          sync.Mutex
+		rateLimiter *rate.Limiter
+		limit       config.RestrictorLimit
+		share       int
+		maxQueue    int
+		queue       admissionQueue
+		seq         uint64
+		timer       *time.Timer
+	}
+	// slidingWindowLog 记录最大窗口内每次请求的时间，精确但内存随限额增长
+	slidingWindowLog struct {
+		mu        sync.Mutex
+		windows   []config.RestrictorWindow
+		logSlice  []time.Time //按时间升序
+		maxWindow time.Duration
+	}
+	// slidingWindowCounter 以上一固定窗口的计数按时间比例加权估算，每个窗口只保存两个计数
+	slidingWindowCounter struct {
+		mu           sync.Mutex
+		windows      []config.RestrictorWindow
+		counterSlice []windowCounter
+	}
+	windowCounter struct {
+		start    time.Time
+		current  int
+		previous int
+	}
+)
+
+func newTokenBucket(limit config.RestrictorLimit, maxQueue int) *tokenBucket {
+	return &tokenBucket{rateLimiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.MaxToken), limit: limit, share: 1, maxQueue: maxQueue}
+}
+
+func (bucket *tokenBucket) take(ctx context.Context, now time.Time, share int, class *admissionClass) rateLimitStatus {
+	allowed := bucket.admit(ctx, now, share, class)
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	status := rateLimitStatus{allowed: allowed, retryAfter: retryAfter(bucket.rateLimiter)}
+	tokens := bucket.rateLimiter.TokensAt(time.Now())
+	status.limit = bucket.rateLimiter.Burst()
+	status.remaining = int(math.Max(0, math.Floor(tokens)))
+	if limit := float64(bucket.rateLimiter.Limit()); limit > 0 && tokens < float64(status.limit) {
+		status.reset = int(math.Ceil((float64(status.limit) - tokens) / limit))
+	}
+	return status
+}
+
+// resize 集群实例数变化时调整令牌桶，调用方需持有锁
+func (bucket *tokenBucket) resize(now time.Time, share int) {
+	if bucket.share == share {
+		return
+	}
+	bucket.share = share
+	bucket.rateLimiter.SetLimitAt(now, rate.Limit(float64(bucket.limit.Rate)/float64(share)))
+	bucket.rateLimiter.SetBurstAt(now, shareLimit(bucket.limit.MaxToken, share))
+}
+
+// admit 有令牌且无排队请求时直接放行，否则按等级排队，超过等级的 max_wait 或队列已满时限流
+func (bucket *tokenBucket) admit(ctx context.Context, now time.Time, share int, class *admissionClass) bool {
+	bucket.mu.Lock()
+	bucket.resize(now, share)
+	if len(bucket.queue) == 0 && bucket.rateLimiter.AllowN(now, 1) {
+		bucket.mu.Unlock()
+		return true
+	}
+	if class.maxWait <= 0 || len(bucket.queue) >= bucket.maxQueue {
+		bucket.mu.Unlock()
+		return false
+	}
+	waiter := &queueWaiter{class: class, seq: bucket.seq, ready: make(chan struct{})}
+	bucket.seq++
+	heap.Push(&bucket.queue, waiter)
+	atomic.AddInt64(&class.depth, 1)
+	bucket.dispatch(now)
+	bucket.mu.Unlock()
+
+	timer := time.NewTimer(class.maxWait)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	//超时的同时已被放行
+	if waiter.index < 0 {
+		return true
+	}
+	heap.Remove(&bucket.queue, waiter.index)
+	atomic.AddInt64(&class.depth, -1)
+	return false
+}
+
+// dispatch 按等级放行排队请求，令牌不足时在下一个令牌生成时再次放行，调用方需持有锁
+func (bucket *tokenBucket) dispatch(now time.Time) {
+	for len(bucket.queue) > 0 && bucket.rateLimiter.AllowN(now, 1) {
+		waiter := heap.Pop(&bucket.queue).(*queueWaiter)
+		atomic.AddInt64(&waiter.class.depth, -1)
+		close(waiter.ready)
+	}
+	limit := float64(bucket.rateLimiter.Limit())
+	if len(bucket.queue) == 0 || limit <= 0 || bucket.rateLimiter.Burst() < 1 {
+		return
+	}
+	delay := time.Duration((1 - bucket.rateLimiter.TokensAt(now)) / limit * float64(time.Second))
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	if bucket.timer != nil {
+		bucket.timer.Stop()
+	}
+	bucket.timer = time.AfterFunc(delay, func() {
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		bucket.dispatch(time.Now())
+	})
+}
+
+func newSlidingWindowLog(windows []config.RestrictorWindow) *slidingWindowLog {
+	bucket := &slidingWindowLog{windows: windows}
+	for _, window := range windows {
+		if size := time.Duration(window.Window) * time.Second; size > bucket.maxWindow {
+			bucket.maxWindow = size
+		}
+	}
+	return bucket
+}
+
+func (bucket *slidingWindowLog) take(ctx context.Context, now time.Time, share int, class *admissionClass) rateLimitStatus {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.logSlice = bucket.logSlice[searchAfter(bucket.logSlice, now.Add(-bucket.maxWindow)):]
+	statusSlice := make([]rateLimitStatus, 0, len(bucket.windows))
+	allowed := true
+	for _, window := range bucket.windows {
+		size := time.Duration(window.Window) * time.Second
+		limit := shareLimit(window.Limit, share)
+		first := searchAfter(bucket.logSlice, now.Add(-size))
+		count := len(bucket.logSlice) - first
+		status := rateLimitStatus{limit: limit, remaining: limit - count, reset: window.Window}
+		if count > 0 {
+			status.reset = ceilSeconds(bucket.logSlice[first].Add(size).Sub(now))
+		}
+		if count >= limit {
+			//需等待超出部分中最早的一次请求移出窗口
+			allowed = false
+			status.retryAfter = ceilSeconds(bucket.logSlice[first+count-limit].Add(size).Sub(now))
+		}
+		statusSlice = append(statusSlice, status)
+	}
+	if allowed {
+		bucket.logSlice = append(bucket.logSlice, now)
+	}
+	return mergeWindowStatus(statusSlice, allowed)
+}
+
+func newSlidingWindowCounter(windows []config.RestrictorWindow) *slidingWindowCounter {
+	return &slidingWindowCounter{windows: windows, counterSlice: make([]windowCounter, len(windows))}
+}
+
+func (bucket *slidingWindowCounter) take(ctx context.Context, now time.Time, share int, class *admissionClass) rateLimitStatus {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	statusSlice := make([]rateLimitStatus, 0, len(bucket.windows))
+	allowed := true
+	for i, window := range bucket.windows {
+		size := time.Duration(window.Window) * time.Second
+		counter := &bucket.counterSlice[i]
+		start := now.Truncate(size)
+		if !counter.start.Equal(start) {
+			if start.Sub(counter.start) == size {
+				counter.previous = counter.current
+			} else {
+				counter.previous = 0
+			}
+			counter.current = 0
+			counter.start = start
+		}
+		elapsed := now.Sub(start)
+		estimated := float64(counter.previous)*(1-float64(elapsed)/float64(size)) + float64(counter.current)
+		limit := shareLimit(window.Limit, share)
+		status := rateLimitStatus{limit: limit, remaining: int(math.Max(0, math.Floor(float64(limit)-estimated))), reset: ceilSeconds(size - elapsed)}
+		if estimated+1 > float64(limit) {
+			allowed = false
+			status.retryAfter = status.reset
+			if counter.current+1 <= limit && counter.previous > 0 {
+				//上一窗口的权重降至可容纳本次请求的时间
+				weight := float64(limit-counter.current-1) / float64(counter.previous)
+				status.retryAfter = ceilSeconds(time.Duration((1-weight)*float64(size)) - elapsed)
+			}
+		}
+		statusSlice = append(statusSlice, status)
+	}
+	if allowed {
+		for i := range bucket.counterSlice {
+			bucket.counterSlice[i].current++
+		}
+	}
+	return mergeWindowStatus(statusSlice, allowed)
+}
+
+// mergeWindowStatus 放行时各窗口额度减一，返回剩余额度最少的窗口；被限流时重试间隔取各窗口最大值
+func mergeWindowStatus(statusSlice []rateLimitStatus, allowed bool) rateLimitStatus {
+	merged := rateLimitStatus{allowed: allowed, remaining: math.MaxInt32}
+	for _, status := range statusSlice {
+		if allowed {
+			status.remaining--
+		}
+		if status.remaining < 0 {
+			status.remaining = 0
+		}
+		if status.remaining < merged.remaining || (status.remaining == merged.remaining && status.reset > merged.reset) {
+			merged.limit, merged.remaining, merged.reset = status.limit, status.remaining, status.reset
+		}
+		if status.retryAfter > merged.retryAfter {
+			merged.retryAfter = status.retryAfter
+		}
+	}
+	if merged.remaining == math.MaxInt32 {
+		merged.remaining = 0
+	}
+	if !allowed && merged.retryAfter < 1 {
+		merged.retryAfter = 1
+	}
+	return merged
+}
+
+// writeRateLimitHeaders 按IETF RateLimit header草案返回额度
+func writeRateLimitHeaders(header http.Header, status rateLimitStatus) {
+	header.Set("RateLimit-Limit", strconv.Itoa(status.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(status.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(status.reset))
+}
+
+// searchAfter 第一个晚于t的位置
+func searchAfter(timeSlice []time.Time, t time.Time) int {
+	return sort.Search(len(timeSlice), func(i int) bool {
+		return timeSlice[i].After(t)
+	})
+}
+
+// shareLimit 集群限流时各实例的限额，至少为1
+func shareLimit(limit int, share int) int {
+	return int(math.Max(1, math.Ceil(float64(limit)/float64(share))))
+}
+
+func ceilSeconds(duration time.Duration) int {
+	if duration <= 0 {
+		return 0
+	}
+	return int(math.Ceil(duration.Seconds()))
+}
+
+// retryAfter 生成一个令牌所需时间，向上取整
+func retryAfter(rateLimiter *rate.Limiter) int {
+	limit := float64(rateLimiter.Limit())
+	if limit <= 0 || limit >= 1 {
+		return 1
+	}
+	return int(math.Ceil(1 / limit))
+}
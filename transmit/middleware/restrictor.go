@@ -2,38 +2,182 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"time"
 
 	"simple_proxygateway/config"
+)
+
+// ClusterSizer 存活的网关实例数，由 etcd.LocalCache 实现，第二个返回值为false时按本地限额限流
+type ClusterSizer interface {
+	ClusterSize() (int, bool)
+}
+
+type (
+	restrictor struct {
+		open         bool
+		config       config.Restrictor
+		limiterStore *keyedStore
+		classes      admissionClasses
+	}
+	clusterSizerKey struct{}
+)
 
-	"golang.org/x/time/rate"
+var (
+	RestrictorWindowsErr         = errors.New("restrictor windows invalid")
+	defaultRestrictorMaxKeys     = 10000
+	defaultRestrictorIdleTimeout = 600
 )
 
-type restrictor struct {
-	open        bool
-	rateLimiter *rate.Limiter
-	waitTime    int
+const RestrictorQueueDepthGauge = "restrictor_queue_depth"
+
+func buildRestrictorHandler(proxyConfig config.Client, params map[string]interface{}) (Middleware, error) {
+	maxKeys := proxyConfig.Restrictor.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultRestrictorMaxKeys
+	}
+	idleTimeout := proxyConfig.Restrictor.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultRestrictorIdleTimeout
+	}
+	switch proxyConfig.Restrictor.Algorithm {
+	case "", config.RestrictorAlgorithmTokenBucket:
+	case config.RestrictorAlgorithmSlidingWindowLog, config.RestrictorAlgorithmSlidingWindowCounter:
+		if err := checkRestrictorWindows(proxyConfig.Restrictor); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown restrictor algorithm:%s", proxyConfig.Restrictor.Algorithm)
+	}
+	restrictorHandler := restrictor{
+		open:         proxyConfig.Restrictor.Open,
+		config:       proxyConfig.Restrictor,
+		limiterStore: newKeyedStore(maxKeys, time.Duration(idleTimeout)*time.Second),
+		classes:      newAdmissionClasses(proxyConfig.Restrictor.Queue, proxyConfig.Restrictor.WaitTime),
+	}
+	if restrictorHandler.config.Queue.MaxSize <= 0 {
+		restrictorHandler.config.Queue.MaxSize = defaultRestrictorQueueMaxSize
+	}
+	return restrictorHandler, nil
+}
+
+// checkRestrictorWindows 滑动窗口算法不使用 rate 及 max_token，未配置全局窗口时路由及等级无窗口可沿用，视为配置错误
+func checkRestrictorWindows(restrictorConfig config.Restrictor) error {
+	if len(restrictorConfig.Windows) == 0 {
+		return RestrictorWindowsErr
+	}
+	windowsMap := map[string][]config.RestrictorWindow{"": restrictorConfig.Windows}
+	for routeName, limit := range restrictorConfig.Routes {
+		windowsMap["route:"+routeName] = limit.Windows
+	}
+	for tier, limit := range restrictorConfig.Tiers {
+		windowsMap["tier:"+tier] = limit.Windows
+	}
+	for limitName, windows := range windowsMap {
+		for _, window := range windows {
+			if window.Limit <= 0 || window.Window <= 0 {
+				return fmt.Errorf("%w:%s limit and window must be greater than 0", RestrictorWindowsErr, limitName)
+			}
+		}
+	}
+	return nil
+}
+
+// Gauges 各排队等级的排队数，指标名称为 restrictor_queue_depth.等级名称
+func (restrictor restrictor) Gauges() map[string]int64 {
+	gaugeMap := make(map[string]int64)
+	for className, depth := range restrictor.classes.queueDepth() {
+		gaugeMap[RestrictorQueueDepthGauge+"."+className] = depth
+	}
+	return gaugeMap
+}
+
+func (restrictor restrictor) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if restrictor.open {
+			now := time.Now()
+			status := restrictor.bucket(r, now).take(r.Context(), now, restrictor.share(r), restrictor.classes.class(r))
+			writeRateLimitHeaders(w.Header(), status)
+			if !status.allowed {
+				Reject(w, r, &LimitError{Code: RateLimitedErr.Code, Msg: RateLimitedErr.Msg, RetryAfter: status.retryAfter})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NewClusterSizerContext 将实例数写入请求上下文，由转发实例在请求进入中间件前设置
+func NewClusterSizerContext(ctx context.Context, clusterSizer ClusterSizer) context.Context {
+	return context.WithValue(ctx, clusterSizerKey{}, clusterSizer)
 }
 
-var restrictorHandler restrictor
+// bucket 按限流维度及适用的限流配置取得限流状态，不同限流配置互相独立
+func (restrictor restrictor) bucket(r *http.Request, now time.Time) limitBucket {
+	limitName, limit := restrictor.limit(r)
+	return restrictor.limiterStore.get(restrictor.key(r)+"\n"+limitName, now, func() interface{} {
+		switch restrictor.config.Algorithm {
+		case config.RestrictorAlgorithmSlidingWindowLog:
+			return newSlidingWindowLog(limit.Windows)
+		case config.RestrictorAlgorithmSlidingWindowCounter:
+			return newSlidingWindowCounter(limit.Windows)
+		}
+		return newTokenBucket(limit, restrictor.config.Queue.MaxSize)
+	}).(limitBucket)
+}
 
-func buildRestrictorHandler(proxyConfig config.Client) limiterHandler {
-	restrictorHandler = restrictor{
-		open:        proxyConfig.Restrictor.Open,
-		waitTime:    proxyConfig.Restrictor.WaitTime,
-		rateLimiter: rate.NewLimiter(rate.Limit(proxyConfig.Restrictor.Rate), proxyConfig.Restrictor.MaxToken),
+// share 集群限流时限额的均分数，etcd不可用时为1，即按本地限额限流
+func (restrictor restrictor) share(r *http.Request) int {
+	if !restrictor.config.Cluster.Open {
+		return 1
+	}
+	clusterSizer, ok := r.Context().Value(clusterSizerKey{}).(ClusterSizer)
+	if !ok || clusterSizer == nil {
+		return 1
+	}
+	if size, fresh := clusterSizer.ClusterSize(); fresh && size > 1 {
+		return size
 	}
-	return restrictorHandler
+	return 1
 }
 
-func (restrictor restrictor) limiterHandleFunc(ip string) bool {
-	if !restrictor.open {
-		return true
+// limit 接入方等级限流优先，其次路由限流，均未配置时使用全局配置；未配置窗口时沿用全局窗口
+func (restrictor restrictor) limit(r *http.Request) (string, config.RestrictorLimit) {
+	limitName, limit := "", config.RestrictorLimit{Rate: restrictor.config.Rate, MaxToken: restrictor.config.MaxToken}
+	routeName := RouteName(r.URL.Path)
+	if routeLimit, ok := restrictor.config.Routes[routeName]; ok {
+		limitName, limit = "route:"+routeName, routeLimit
 	}
-	ctx, _ := context.WithTimeout(context.Background(), time.Duration(restrictor.waitTime)*time.Second)
-	err := restrictor.rateLimiter.Wait(ctx)
-	if err != nil {
-		return false
+	if consumer, ok := ConsumerFrom(r); ok && consumer.Tier != "" {
+		if tierLimit, ok := restrictor.config.Tiers[consumer.Tier]; ok {
+			limitName, limit = "tier:"+consumer.Tier, tierLimit
+		}
+	}
+	if len(limit.Windows) == 0 {
+		limit.Windows = restrictor.config.Windows
+	}
+	return limitName, limit
+}
+
+// key 限流维度，consumer及header取不到时按ip限流
+func (restrictor restrictor) key(r *http.Request) string {
+	switch restrictor.config.Key {
+	case config.RestrictorKeyIp:
+		return "ip:" + ClientIp(r)
+	case config.RestrictorKeyConsumer:
+		if consumer, ok := ConsumerFrom(r); ok {
+			return "consumer:" + consumer.Id
+		}
+		return "ip:" + ClientIp(r)
+	case config.RestrictorKeyHeader:
+		if value := r.Header.Get(restrictor.config.KeyHeader); value != "" {
+			return "header:" + value
+		}
+		return "ip:" + ClientIp(r)
+	case config.RestrictorKeyRoute:
+		return "route:" + RouteName(r.URL.Path)
 	}
-	return true
+	return ""
 }
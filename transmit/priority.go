@@ -0,0 +1,35 @@
+package transmit
+
+import (
+	"sort"
+
+	"simple_proxygateway/config"
+)
+
+// selectPriorityTier 返回存在健康节点的最高优先级(Priority最小)分组，
+// 备用分组仅在更高优先级分组全部不可用时启用，均不可用时返回最高优先级分组
+func (p *Proxy) selectPriorityTier(urlSlice []config.ServiceUrlStruct) []config.ServiceUrlStruct {
+	if len(urlSlice) == 0 {
+		return urlSlice
+	}
+	tierMap := make(map[int][]config.ServiceUrlStruct)
+	prioritySlice := make([]int, 0)
+	for _, urlStruct := range urlSlice {
+		if _, ok := tierMap[urlStruct.Priority]; !ok {
+			prioritySlice = append(prioritySlice, urlStruct.Priority)
+		}
+		tierMap[urlStruct.Priority] = append(tierMap[urlStruct.Priority], urlStruct)
+	}
+	if len(prioritySlice) == 1 {
+		return urlSlice
+	}
+	sort.Ints(prioritySlice)
+	for _, priority := range prioritySlice {
+		for _, urlStruct := range tierMap[priority] {
+			if p.isEndpointHealthy(urlStruct.Url) {
+				return tierMap[priority]
+			}
+		}
+	}
+	return tierMap[prioritySlice[0]]
+}
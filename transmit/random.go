@@ -2,6 +2,7 @@ package transmit
 
 import (
 	"math/rand"
+	"net/http"
 	"time"
 
 	"simple_proxygateway/config"
@@ -11,10 +12,10 @@ type randomTransmit struct {
 }
 
 func init() {
-	register(config.LoadBalanceModeRandom, &randomTransmit{})
+	RegisterBalancer(config.LoadBalanceModeRandom, &randomTransmit{})
 }
 
-func (randomTransmit randomTransmit) getUrlString(urlSlice []config.ServiceUrlStruct, ip string) string {
+func (randomTransmit randomTransmit) Pick(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
 	rand.Seed(time.Now().UnixNano())
 	sliceLen := len(urlSlice)
 	randIndex := rand.Intn(sliceLen)
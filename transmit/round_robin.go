@@ -1,26 +1,26 @@
 package transmit
 
 import (
+	"net/http"
 	"sync/atomic"
 
 	"simple_proxygateway/config"
 )
 
+// roundRobinTransmit 轮询下标由转发实例持有
 type roundRobinTransmit struct {
+	currentIndex uint32
 }
 
 func init() {
-	register(config.LoadBalanceModeRoundRobin, &roundRobinTransmit{})
+	RegisterBalancer(config.LoadBalanceModeRoundRobin, &roundRobinTransmit{})
 }
 
-var currentIndex int32 = 0
+func (roundRobin *roundRobinTransmit) NewBalancer() Balancer {
+	return &roundRobinTransmit{}
+}
 
-func (roundRobinTransmit) getUrlString(urlSlice []config.ServiceUrlStruct, ip string) string {
-	sliceLen := len(urlSlice)
-	if currentIndex > int32(sliceLen) {
-		atomic.StoreInt32(&currentIndex, 0)
-	}
-	index := atomic.AddInt32(&currentIndex, 1) % int32(sliceLen)
+func (roundRobin *roundRobinTransmit) Pick(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
+	index := atomic.AddUint32(&roundRobin.currentIndex, 1) % uint32(len(urlSlice))
 	return urlSlice[index].Url
-
 }
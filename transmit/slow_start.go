@@ -0,0 +1,32 @@
+package transmit
+
+import (
+	"time"
+
+	"simple_proxygateway/config"
+)
+
+// 权重放大倍数，使权重较小的节点也能平滑爬升
+const slowStartWeightScale = 100
+
+// applySlowStart 新增节点的有效权重在预热窗口内由接近0线性提升至配置权重
+func applySlowStart(urlSlice []config.ServiceUrlStruct, addTimeMap map[string]time.Time, now time.Time, slowStartWindow time.Duration) []config.ServiceUrlStruct {
+	if slowStartWindow <= 0 {
+		return urlSlice
+	}
+	resultSlice := make([]config.ServiceUrlStruct, len(urlSlice))
+	for i, urlStruct := range urlSlice {
+		weight := urlStruct.Weight * slowStartWeightScale
+		if addTime, ok := addTimeMap[urlStruct.Url]; ok && !addTime.IsZero() {
+			if elapsed := now.Sub(addTime); elapsed < slowStartWindow {
+				weight = int(int64(weight) * int64(elapsed) / int64(slowStartWindow))
+				if weight < 1 && urlStruct.Weight > 0 {
+					weight = 1
+				}
+			}
+		}
+		urlStruct.Weight = weight
+		resultSlice[i] = urlStruct
+	}
+	return resultSlice
+}
@@ -0,0 +1,110 @@
+package transmit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/crc32"
+	mathRand "math/rand"
+	"net/http"
+
+	"simple_proxygateway/config"
+	"simple_proxygateway/transmit/middleware"
+)
+
+const defaultStickyCookieName = "gateway_split"
+
+type (
+	// splitChoice 单个请求的切分结果，中间件提前解析后转发时沿用，保证并发限制与实际转发的服务一致
+	splitChoice struct {
+		resolved    bool
+		serviceName string
+		cookie      *http.Cookie
+	}
+	splitChoiceKey struct{}
+)
+
+// ResolveService 实现 middleware.ServiceResolver，返回请求按流量切分实际转发的服务
+func (p *Proxy) ResolveService(r *http.Request) string {
+	serviceName, _ := p.resolveSplit(r, middleware.RouteName(r.URL.Path))
+	return serviceName
+}
+
+// resolveSplit 同一请求只切分一次
+func (p *Proxy) resolveSplit(req *http.Request, routeName string) (string, *http.Cookie) {
+	choice, ok := req.Context().Value(splitChoiceKey{}).(*splitChoice)
+	if !ok {
+		return p.getSplitServiceName(req, routeName)
+	}
+	if !choice.resolved {
+		choice.serviceName, choice.cookie = p.getSplitServiceName(req, routeName)
+		choice.resolved = true
+	}
+	return choice.serviceName, choice.cookie
+}
+
+// getSplitServiceName 按路由的流量切分配置选择实际转发的服务，新签发的粘性cookie需回写至响应
+func (p *Proxy) getSplitServiceName(req *http.Request, routeName string) (string, *http.Cookie) {
+	splitSlice := p.serviceDiscover.GetSplit(routeName)
+	if len(splitSlice) == 0 {
+		return routeName, nil
+	}
+	sticky := p.routeMap[routeName].Sticky
+	var stickyKey string
+	var newCookie *http.Cookie
+	switch sticky.Mode {
+	case config.StickyModeCookie:
+		cookieName := sticky.Key
+		if cookieName == "" {
+			cookieName = defaultStickyCookieName
+		}
+		if cookie, err := req.Cookie(cookieName); err == nil && cookie.Value != "" {
+			stickyKey = cookie.Value
+		} else {
+			stickyKey = newStickyId()
+			newCookie = &http.Cookie{Name: cookieName, Value: stickyKey, Path: "/", MaxAge: sticky.MaxAge, HttpOnly: true}
+		}
+	case config.StickyModeHeader:
+		stickyKey = req.Header.Get(sticky.Key)
+	}
+	serviceName := pickSplitService(splitSlice, stickyKey)
+	if serviceName == "" {
+		return routeName, nil
+	}
+	return serviceName, newCookie
+}
+
+// pickSplitService stickyKey为空时随机选择，否则按hash落入固定区间
+func pickSplitService(splitSlice []config.SplitStruct, stickyKey string) string {
+	totalWeight := 0
+	for _, split := range splitSlice {
+		if split.Weight > 0 {
+			totalWeight += split.Weight
+		}
+	}
+	if totalWeight == 0 {
+		return ""
+	}
+	var point int
+	if stickyKey == "" {
+		point = mathRand.Intn(totalWeight)
+	} else {
+		point = int(crc32.ChecksumIEEE([]byte(stickyKey)) % uint32(totalWeight))
+	}
+	index := 0
+	for _, split := range splitSlice {
+		if split.Weight <= 0 {
+			continue
+		}
+		index += split.Weight
+		if index > point {
+			return split.ServiceName
+		}
+	}
+	return ""
+}
+
+func newStickyId() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,68 @@
+package transmit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ServiceStatistics 服务转发累计统计，使用方自行对两次快照做差值
+type ServiceStatistics struct {
+	RequestCount int64
+	ErrorCount   int64
+	LatencyTotal int64 //累计耗时(毫秒)
+}
+
+func (p *Proxy) recordStatistics(serviceName string, statusCode int, latency time.Duration) {
+	if serviceName == "" {
+		return
+	}
+	statisticsObj, _ := p.statisticsMap.LoadOrStore(serviceName, &ServiceStatistics{})
+	statistics := statisticsObj.(*ServiceStatistics)
+	atomic.AddInt64(&statistics.RequestCount, 1)
+	atomic.AddInt64(&statistics.LatencyTotal, latency.Milliseconds())
+	if statusCode >= 500 {
+		atomic.AddInt64(&statistics.ErrorCount, 1)
+	}
+}
+
+// GetStatistics 当前实例的服务转发累计统计
+func (p *Proxy) GetStatistics(serviceName string) ServiceStatistics {
+	if statisticsObj, ok := p.statisticsMap.Load(serviceName); ok {
+		statistics := statisticsObj.(*ServiceStatistics)
+		return ServiceStatistics{
+			RequestCount: atomic.LoadInt64(&statistics.RequestCount),
+			ErrorCount:   atomic.LoadInt64(&statistics.ErrorCount),
+			LatencyTotal: atomic.LoadInt64(&statistics.LatencyTotal),
+		}
+	}
+	return ServiceStatistics{}
+}
+
+// Sub 计算区间统计
+func (statistics ServiceStatistics) Sub(before ServiceStatistics) ServiceStatistics {
+	return ServiceStatistics{
+		RequestCount: statistics.RequestCount - before.RequestCount,
+		ErrorCount:   statistics.ErrorCount - before.ErrorCount,
+		LatencyTotal: statistics.LatencyTotal - before.LatencyTotal,
+	}
+}
+
+func (statistics ServiceStatistics) ErrorRate() float64 {
+	if statistics.RequestCount == 0 {
+		return 0
+	}
+	return float64(statistics.ErrorCount) / float64(statistics.RequestCount)
+}
+
+// AvgLatency 平均耗时(毫秒)
+func (statistics ServiceStatistics) AvgLatency() float64 {
+	if statistics.RequestCount == 0 {
+		return 0
+	}
+	return float64(statistics.LatencyTotal) / float64(statistics.RequestCount)
+}
+
+// Gauges 当前实例中间件的指标，如 restrictor 各排队等级的排队数
+func (p *Proxy) Gauges() map[string]int64 {
+	return p.chain.Gauges()
+}
@@ -0,0 +1,46 @@
+package transmit
+
+import (
+	"net/http"
+
+	"simple_proxygateway/config"
+)
+
+// getSubsetSelector 合并路由固定标签及请求头映射标签，请求头优先
+func (p *Proxy) getSubsetSelector(req *http.Request, routeName string) map[string]string {
+	host := p.routeMap[routeName]
+	if len(host.Subset) == 0 && len(host.SubsetHeader) == 0 {
+		return nil
+	}
+	selector := make(map[string]string, len(host.Subset)+len(host.SubsetHeader))
+	for label, value := range host.Subset {
+		selector[label] = value
+	}
+	for header, label := range host.SubsetHeader {
+		if value := req.Header.Get(header); value != "" {
+			selector[label] = value
+		}
+	}
+	return selector
+}
+
+// filterSubset 返回标签全部匹配的节点
+func filterSubset(urlSlice []config.ServiceUrlStruct, selector map[string]string) []config.ServiceUrlStruct {
+	if len(selector) == 0 {
+		return urlSlice
+	}
+	subsetSlice := make([]config.ServiceUrlStruct, 0, len(urlSlice))
+	for _, urlStruct := range urlSlice {
+		match := true
+		for label, value := range selector {
+			if urlStruct.Labels[label] != value {
+				match = false
+				break
+			}
+		}
+		if match {
+			subsetSlice = append(subsetSlice, urlStruct)
+		}
+	}
+	return subsetSlice
+}
@@ -1,6 +1,7 @@
 package transmit
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -11,51 +12,100 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"simple_proxygateway/collector"
 	"simple_proxygateway/config"
 	"simple_proxygateway/etcd"
 	"simple_proxygateway/logger"
+	"simple_proxygateway/transmit/errorpage"
 	"simple_proxygateway/transmit/middleware"
 
-	jsoniter "github.com/json-iterator/go"
 	"github.com/patrickmn/go-cache"
 )
 
-type transmitHandler interface {
-	getUrlString(urlSlice []config.ServiceUrlStruct, ip string) string
+// Balancer 负载均衡，从已过滤的候选节点中选择转发节点，返回节点Url
+// 候选节点已排除下线、不健康及不匹配子集的节点，可通过 Labels 读取节点元数据
+type Balancer interface {
+	Pick(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string
+}
+
+// BalancerFunc 函数形式的 Balancer
+type BalancerFunc func(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string
+
+func (f BalancerFunc) Pick(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
+	return f(req, serviceName, urlSlice)
+}
+
+// BalancerCreator 有状态的负载均衡实现该接口，每个转发实例创建时调用 NewBalancer 获得独立的 Balancer，实例间不共享状态
+type BalancerCreator interface {
+	NewBalancer() Balancer
+}
+
+// transmitState 单次转发过程中Director与ModifyResponse/ErrorHandler间共享的状态
+type transmitState struct {
+	cookieSlice []*http.Cookie
+	serviceName string
+	routeName   string
+	originPath  string
+	startTime   time.Time
+}
+
+type transmitStateKey struct{}
+
+// Proxy 网关转发实例，路由配置、失败统计、节点摘除及转发统计等状态均由实例持有，
+// 同一进程内可创建多个互不影响的实例
+type Proxy struct {
+	serviceDiscover    etcd.ServiceDiscover
+	collector          *collector.Collector
+	pages              *errorpage.Pages
+	balancer           Balancer //负载均衡模式未注册时为nil
+	defaultUrl         string
+	zone               string
+	zoneAware          config.ZoneAware
+	slowStartWindow    time.Duration
+	drainTimeout       time.Duration
+	routeMap           map[string]config.ReverseHost
+	errorCache         *cache.Cache
+	endpointErrorCache *cache.Cache
+	endpointEjectCache *cache.Cache
+	affinity           *affinity
+	statisticsMap      sync.Map
+	chain              *middleware.Chain
 }
 
 var (
-	transmitHandlerMap           = make(map[string]transmitHandler)
-	localCache                   *cache.Cache
-	localCacheDefaultExpiration  = 10
-	localCacheCleanUpTime        = 30
-	defaultUrl                   string
+	balancerMap                  = make(map[string]Balancer)
 	transmitErrorMaxCount        = 5
-	errorCache                   *cache.Cache
 	errorCacheDefaultExpiration  = 300
 	errorCacheDefaultCleanUpTime = 600
 )
 
-func init() {
-	localCache = cache.New(time.Duration(localCacheDefaultExpiration)*time.Second, time.Duration(localCacheCleanUpTime)*time.Second)
-	errorCache = cache.New(time.Duration(errorCacheDefaultExpiration)*time.Second, time.Duration(errorCacheDefaultCleanUpTime)*time.Second)
-}
-
-func NewProxyHandler(serviceDiscover etcd.ServiceDiscover, loadBalanceMode string, proxyConfig config.Client) http.Handler {
-	defaultUrl = proxyConfig.DefaultUrl
-	middleware.Limiter.SetConfig(proxyConfig)
+// NewProxyHandler 创建转发实例，请求依次经过中间件后转发至上游，eventCollector 为nil时不采集转发记录
+func NewProxyHandler(serviceDiscover etcd.ServiceDiscover, loadBalanceMode string, proxyConfig config.Client, eventCollector *collector.Collector) (*Proxy, error) {
+	p := &Proxy{
+		serviceDiscover:    serviceDiscover,
+		collector:          eventCollector,
+		pages:              errorpage.New(proxyConfig),
+		balancer:           newBalancer(loadBalanceMode),
+		defaultUrl:         proxyConfig.DefaultUrl,
+		zone:               proxyConfig.Zone,
+		zoneAware:          proxyConfig.ZoneAware,
+		slowStartWindow:    time.Duration(proxyConfig.SlowStart) * time.Second,
+		drainTimeout:       time.Duration(proxyConfig.DrainTimeout) * time.Second,
+		routeMap:           make(map[string]config.ReverseHost),
+		errorCache:         cache.New(time.Duration(errorCacheDefaultExpiration)*time.Second, time.Duration(errorCacheDefaultCleanUpTime)*time.Second),
+		endpointErrorCache: cache.New(time.Duration(errorCacheDefaultExpiration)*time.Second, time.Duration(endpointErrorCacheCleanTime)*time.Second),
+		endpointEjectCache: cache.New(time.Duration(endpointEjectTime)*time.Second, time.Duration(endpointErrorCacheCleanTime)*time.Second),
+		affinity:           newAffinity(proxyConfig.SessionAffinity),
+	}
+	for _, host := range proxyConfig.ReverseHost {
+		p.routeMap[host.ServiceName] = host
+	}
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			middlewareResult := middleware.Limiter.Handle(req.RemoteAddr)
-			var rawUrl, serviceName string
-			if middlewareResult {
-				rawUrl, serviceName = getRawUrlAndServiceName(req.URL, req.RemoteAddr, loadBalanceMode, serviceDiscover)
-			} else {
-				rawUrl, serviceName = "", ""
-			}
+			rawUrl, serviceName := p.getRawUrlAndServiceName(req)
 			u, _ := url.Parse(rawUrl)
 			req.URL = u
 			req.Host = u.Host // 必须显示修改Host，否则转发可能失败
@@ -63,12 +113,18 @@ func NewProxyHandler(serviceDiscover etcd.ServiceDiscover, loadBalanceMode strin
 			req.Header.Add("Transmit-Time", strconv.FormatInt(time.Now().Unix(), 10))
 		},
 		ModifyResponse: func(resp *http.Response) error {
+			if state, ok := resp.Request.Context().Value(transmitStateKey{}).(*transmitState); ok {
+				for _, cookie := range state.cookieSlice {
+					resp.Header.Add("Set-Cookie", cookie.String())
+				}
+				p.recordStatistics(state.serviceName, resp.StatusCode, time.Since(state.startTime))
+			}
 			infoLog := fmt.Sprintf("source host:%s,path:%s,code:%d", resp.Request.URL.Host, resp.Request.URL.Path, resp.StatusCode)
 			logger.Runtime.Info(infoLog)
 			go func() {
 				//转发记录采集
 				transmitTime, _ := strconv.Atoi(resp.Request.Header.Get("Transmit-Time"))
-				collector.Write(collector.EsMsg{
+				p.collector.Write(collector.EsMsg{
 					ServiceName:      resp.Request.Header.Get("Service"),
 					TransmitTime:     transmitTime,
 					ResultTime:       int(time.Now().Unix()),
@@ -83,51 +139,56 @@ func NewProxyHandler(serviceDiscover etcd.ServiceDiscover, loadBalanceMode strin
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			if err != nil {
 				logger.Runtime.Error(err.Error())
-				w.Header().Set("Content-Type", "application/json")
-				//Host 为空时，默认为限流或ip黑名单等限制
-				errStruct := new(struct {
-					Msg  string
-					Data interface{}
-					Code int
-				})
-				if r.URL.Host == "" {
-					w.WriteHeader(http.StatusInternalServerError)
-					errStruct.Msg = "error!temporarily unavailable for service"
-					errStruct.Data = ""
-					errStruct.Code = http.StatusInternalServerError
-				} else {
-					w.WriteHeader(http.StatusNotFound)
-					errStruct.Msg = "error!service not found!"
-					errStruct.Data = ""
-					errStruct.Code = http.StatusNotFound
+				state, _ := r.Context().Value(transmitStateKey{}).(*transmitState)
+				if state == nil {
+					state = &transmitState{startTime: time.Now()}
+				}
+				page := errorpage.Page{
+					RequestId: r.Header.Get(errorpage.RequestIdHeader),
+					Service:   state.serviceName,
+					Path:      state.originPath,
+				}
+				upstreamErr := false
+				switch {
+				case r.URL.Host == "":
+					page.Code, page.Msg = http.StatusNotFound, "service not found!"
+				case isTimeoutErr(err):
+					page.Code, page.Msg = http.StatusGatewayTimeout, "upstream timeout"
+					upstreamErr = true
+				default:
+					page.Code, page.Msg = http.StatusBadGateway, "upstream unavailable"
+					upstreamErr = true
 				}
 				serviceName := r.Header.Get("Service")
+				p.recordStatistics(state.serviceName, page.Code, time.Since(state.startTime))
 				go func() {
 					//转发记录采集
 					transmitTime, _ := strconv.Atoi(r.Header.Get("Transmit-Time"))
-					collector.Write(collector.EsMsg{
+					p.collector.Write(collector.EsMsg{
 						ServiceName:      serviceName,
 						TransmitTime:     transmitTime,
 						ResultTime:       int(time.Now().Unix()),
 						TransmitDuration: int(time.Now().Unix()) - transmitTime,
 						Host:             r.Host,
-						StatusCode:       errStruct.Code,
+						StatusCode:       page.Code,
 					})
 				}()
-				go func() {
-					//失败统计 放弃强约束降低锁冲突
-					if errorCount, ok := errorCache.Get(serviceName); ok {
-						if errorCount.(int)+1 >= transmitErrorMaxCount {
-							serviceDiscover.Delete(serviceName)
+				if upstreamErr {
+					go p.recordEndpointFailure(r.URL.Host)
+					go func() {
+						//失败统计 放弃强约束降低锁冲突
+						if errorCount, ok := p.errorCache.Get(serviceName); ok {
+							if errorCount.(int)+1 >= transmitErrorMaxCount {
+								p.serviceDiscover.Delete(serviceName)
+							} else {
+								_ = p.errorCache.Increment(serviceName, 1)
+							}
 						} else {
-							_ = errorCache.Increment(serviceName, 1)
+							_ = p.errorCache.Add(serviceName, 1, time.Duration(errorCacheDefaultExpiration)*time.Second)
 						}
-					} else {
-						_ = errorCache.Add(serviceName, 1, time.Duration(errorCacheDefaultExpiration)*time.Second)
-					}
-				}()
-				errJson, _ := jsoniter.Marshal(errStruct)
-				w.Write(errJson)
+					}()
+				}
+				p.pages.Write(w, state.routeName, page)
 			}
 		},
 		Transport: &http.Transport{
@@ -143,26 +204,93 @@ func NewProxyHandler(serviceDiscover etcd.ServiceDiscover, loadBalanceMode strin
 			ExpectContinueTimeout: time.Duration(proxyConfig.HttpTransport.ExpectContinueTimeout) * time.Second, //100-continue 超时时间
 		},
 	}
-	return proxy
+	chain, err := middleware.NewChain(proxyConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &transmitState{
+			startTime:  time.Now(),
+			routeName:  middleware.RouteName(r.URL.Path),
+			originPath: r.URL.Path,
+		}
+		ctx := context.WithValue(r.Context(), transmitStateKey{}, state)
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	if err != nil {
+		return nil, err
+	}
+	p.chain = chain
+	return p, nil
 }
 
-func register(modeName string, transmitHandler transmitHandler) {
-	transmitHandlerMap[modeName] = transmitHandler
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//中间件中断请求时使用实例的错误页，认证中间件通过服务发现查询接入方，集群限流通过服务发现获取实例数，并发限制按切分后的服务计算
+	ctx := errorpage.NewContext(r.Context(), p.pages)
+	ctx = context.WithValue(ctx, splitChoiceKey{}, &splitChoice{})
+	ctx = middleware.NewServiceResolverContext(ctx, p)
+	if consumerStore, ok := p.serviceDiscover.(middleware.ConsumerStore); ok {
+		ctx = middleware.NewConsumerStoreContext(ctx, consumerStore)
+	}
+	if clusterSizer, ok := p.serviceDiscover.(middleware.ClusterSizer); ok {
+		ctx = middleware.NewClusterSizerContext(ctx, clusterSizer)
+	}
+	p.chain.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RegisterBalancer 注册负载均衡模式，modeName 对应配置 load_balance_mode，重复注册时覆盖
+// 自定义负载均衡在 init 中注册，并在网关 main 包中引入所在包即可使用；有状态的负载均衡需实现 BalancerCreator
+func RegisterBalancer(modeName string, balancer Balancer) {
+	balancerMap[modeName] = balancer
+}
+
+// newBalancer 按注册名称获取负载均衡，有状态的负载均衡为每个转发实例单独创建
+func newBalancer(modeName string) Balancer {
+	balancer, ok := balancerMap[modeName]
+	if !ok {
+		return nil
+	}
+	if creator, ok := balancer.(BalancerCreator); ok {
+		return creator.NewBalancer()
+	}
+	return balancer
 }
 
-func getRawUrlAndServiceName(reqUrl *url.URL, originRemoteAddr string, loadBalanceMode string, serviceDiscover etcd.ServiceDiscover) (string, string) {
+func (p *Proxy) getRawUrlAndServiceName(req *http.Request) (string, string) {
+	reqUrl := req.URL
 	reg := regexp.MustCompile(`\/`)
 	pathPieceSlice := reg.Split(reqUrl.Path, -1)
-	serviceName := pathPieceSlice[1]
-	ip, _, _ := net.SplitHostPort(originRemoteAddr)
-	transmitHost := getTransmitHostByCache(ip, serviceName)
+	serviceName, stickyCookie := p.resolveSplit(req, pathPieceSlice[1])
+	cookieSlice := make([]*http.Cookie, 0, 2)
+	if stickyCookie != nil {
+		cookieSlice = append(cookieSlice, stickyCookie)
+	}
+	subset := p.getSubsetSelector(req, pathPieceSlice[1])
+	var transmitHost string
+	if p.affinity.config.Open {
+		transmitHost = p.getTransmitHostByCookie(req, serviceName, subset)
+	}
 	if transmitHost == "" {
-		transmitHost = getTransmitHost(ip, serviceName, loadBalanceMode, serviceDiscover)
+		transmitHost = p.getTransmitHost(req, serviceName, subset)
+		if transmitHost == "" {
+			transmitHost, serviceName = p.getFallbackTransmitHost(req, pathPieceSlice[1])
+		} else if p.affinity.config.Open {
+			cookieSlice = append(cookieSlice, p.affinity.newCookie(serviceName, transmitHost, time.Now()))
+		}
+	}
+	if state, ok := req.Context().Value(transmitStateKey{}).(*transmitState); ok {
+		state.cookieSlice = cookieSlice
+		state.serviceName = serviceName
 	}
 	rawUrl := combineUrl(reqUrl.Scheme, transmitHost, pathPieceSlice[2:], reqUrl.RawQuery)
 	return rawUrl, serviceName
 }
 
+// isTimeoutErr 上游连接或响应超时
+func isTimeoutErr(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func combineUrl(scheme string, transmitHost string, originPathSlice []string, rawQuery string) string {
 	if scheme != "" {
 		scheme = scheme + "://"
@@ -179,27 +307,34 @@ func combineUrl(scheme string, transmitHost string, originPathSlice []string, ra
 	return scheme + transmitHost + pathMix + rawQuery
 }
 
-func getTransmitHostByCache(ip string, serviceName string) string {
-	if ip == "::1" {
-		ip = "127.0.0.1"
-	}
-	if transmitHost, ok := localCache.Get(ip + "_" + serviceName); ok {
-		return transmitHost.(string)
+func (p *Proxy) getTransmitHost(req *http.Request, serviceName string, subset map[string]string) string {
+	var err error
+	if balancer := p.balancer; balancer != nil {
+		serviceSlice, err := p.serviceDiscover.Get(serviceName)
+		if err == nil {
+			urlSlice := p.selectEndpoints(filterDraining(serviceSlice.ServiceUrlSlice), subset)
+			urlSlice = applySlowStart(urlSlice, serviceSlice.AddTimeMap, time.Now(), p.slowStartWindow)
+			if len(urlSlice) > 0 {
+				return balancer.Pick(req, serviceName, urlSlice)
+			}
+		}
 	}
+	err = errors.New("service data not exists")
+	logger.Runtime.Error(fmt.Errorf("transmit error : %w, service:%s", err, serviceName).Error())
 	return ""
 }
 
-func getTransmitHost(ip string, serviceName string, loadBalanceMode string, serviceDiscover etcd.ServiceDiscover) string {
-	var err error
-	if transmitHandler, ok := transmitHandlerMap[loadBalanceMode]; ok {
-		serviceSlice, err := serviceDiscover.Get(serviceName)
-		if err == nil {
-			hostResult := transmitHandler.getUrlString(serviceSlice.ServiceUrlSlice, ip)
-			localCache.Set(ip+"_"+serviceName, hostResult, time.Duration(localCacheDefaultExpiration)*time.Second)
-			return hostResult
+// selectEndpoints 按子集、优先级及区域筛选可分配的节点
+func (p *Proxy) selectEndpoints(urlSlice []config.ServiceUrlStruct, subset map[string]string) []config.ServiceUrlStruct {
+	return p.filterZone(p.selectPriorityTier(filterSubset(urlSlice, subset)), p.zone)
+}
+
+// getFallbackTransmitHost 服务不可用时依次尝试路由配置的降级服务，均不可用时使用default_url
+func (p *Proxy) getFallbackTransmitHost(req *http.Request, routeName string) (string, string) {
+	for _, fallbackName := range p.routeMap[routeName].Fallback {
+		if transmitHost := p.getTransmitHost(req, fallbackName, nil); transmitHost != "" {
+			return transmitHost, fallbackName
 		}
 	}
-	err = errors.New("service data not exists")
-	logger.Runtime.Error(fmt.Errorf("transmit error : %w", err).Error())
-	return defaultUrl
+	return p.defaultUrl, ""
 }
@@ -3,6 +3,8 @@ package transmit
 import (
 	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -41,13 +43,25 @@ func TestCombineUrl(t *testing.T) {
 	})
 }
 
+func newTestProxy(serviceDiscover etcd.ServiceDiscover, loadBalanceMode string, testConfig config.Client) *Proxy {
+	proxy, err := NewProxyHandler(serviceDiscover, loadBalanceMode, testConfig, nil)
+	if err != nil {
+		panic(err)
+	}
+	return proxy
+}
+
 func TestTransmitHost(t *testing.T) {
-	ServiceDiscover := etcd.NewEtcd(*proxyConfig)
+	ServiceDiscover, err := etcd.NewEtcd(*proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ServiceDiscover.Exit()
 	Convey("register handler & add etcd Data", t, func() {
-		register(config.LoadBalanceModeRandom, &randomTransmit{})
-		register(config.LoadBalanceModeIpHash, &ipHashTransmit{})
-		register(config.LoadBalanceModeRoundRobin, &roundRobinTransmit{})
-		register(config.LoadBalanceModeWeight, &weightTransmit{})
+		RegisterBalancer(config.LoadBalanceModeRandom, &randomTransmit{})
+		RegisterBalancer(config.LoadBalanceModeIpHash, &ipHashTransmit{})
+		RegisterBalancer(config.LoadBalanceModeRoundRobin, &roundRobinTransmit{})
+		RegisterBalancer(config.LoadBalanceModeWeight, &weightTransmit{})
 		respL, err := etcdHandler.Grant(context.TODO(), 30)
 		if err != nil {
 			t.Fatal(err)
@@ -68,20 +82,335 @@ func TestTransmitHost(t *testing.T) {
 			log.Fatal(err)
 		}
 		Convey("check random mode", func() {
-			transmitUrl := getTransmitHost("127.0.0.1", proxyConfig.ReverseHost[0].ServiceName, config.LoadBalanceModeRandom, ServiceDiscover)
+			proxy := newTestProxy(ServiceDiscover, config.LoadBalanceModeRandom, *proxyConfig)
+			transmitUrl := proxy.getTransmitHost(httptest.NewRequest("GET", "/test", nil), proxyConfig.ReverseHost[0].ServiceName, nil)
 			So(transmitUrl, ShouldBeIn, []string{"127.0.0.1", "127.0.0.4"})
 		})
 		Convey("check ip hash mode", func() {
-			transmitUrl := getTransmitHost("127.0.0.1", proxyConfig.ReverseHost[0].ServiceName, config.LoadBalanceModeIpHash, ServiceDiscover)
+			proxy := newTestProxy(ServiceDiscover, config.LoadBalanceModeIpHash, *proxyConfig)
+			transmitUrl := proxy.getTransmitHost(httptest.NewRequest("GET", "/test", nil), proxyConfig.ReverseHost[0].ServiceName, nil)
 			So(transmitUrl, ShouldBeIn, []string{"127.0.0.1", "127.0.0.4"})
 		})
 		Convey("check weight mode", func() {
-			transmitUrl := getTransmitHost("127.0.0.1", proxyConfig.ReverseHost[0].ServiceName, config.LoadBalanceModeWeight, ServiceDiscover)
+			proxy := newTestProxy(ServiceDiscover, config.LoadBalanceModeWeight, *proxyConfig)
+			transmitUrl := proxy.getTransmitHost(httptest.NewRequest("GET", "/test", nil), proxyConfig.ReverseHost[0].ServiceName, nil)
 			So(transmitUrl, ShouldBeIn, []string{"127.0.0.1", "127.0.0.4"})
 		})
 		Convey("check round robin mode", func() {
-			transmitUrl := getTransmitHost("127.0.0.1", proxyConfig.ReverseHost[0].ServiceName, config.LoadBalanceModeRoundRobin, ServiceDiscover)
+			proxy := newTestProxy(ServiceDiscover, config.LoadBalanceModeRoundRobin, *proxyConfig)
+			transmitUrl := proxy.getTransmitHost(httptest.NewRequest("GET", "/test", nil), proxyConfig.ReverseHost[0].ServiceName, nil)
 			So(transmitUrl, ShouldBeIn, []string{"127.0.0.1", "127.0.0.4"})
 		})
 	})
 }
+
+func TestWeightPick(t *testing.T) {
+	Convey("weight pick with zero total weight", t, func() {
+		urlSlice := []config.ServiceUrlStruct{{Url: "127.0.0.1:80"}, {Url: "127.0.0.2:80"}}
+		req := httptest.NewRequest("GET", "/test", nil)
+		for i := 0; i < 10; i++ {
+			So(weightTransmit{}.Pick(req, "test", urlSlice), ShouldBeIn, []string{"127.0.0.1:80", "127.0.0.2:80"})
+		}
+		So(weightTransmit{}.Pick(req, "test", []config.ServiceUrlStruct{{Url: "127.0.0.1:80"}, {Url: "127.0.0.2:80", Weight: 1}}), ShouldEqual, "127.0.0.2:80")
+	})
+}
+
+func TestPickSplitService(t *testing.T) {
+	Convey("pickSplitService check", t, func() {
+		splitSlice := []config.SplitStruct{
+			{ServiceName: "orders", Weight: 95},
+			{ServiceName: "orders-canary", Weight: 5},
+		}
+		Convey("sticky key always hits the same service", func() {
+			serviceName := pickSplitService(splitSlice, "user-1")
+			for i := 0; i < 10; i++ {
+				So(pickSplitService(splitSlice, "user-1"), ShouldEqual, serviceName)
+			}
+		})
+		Convey("zero weight service never hit", func() {
+			zeroSlice := []config.SplitStruct{
+				{ServiceName: "orders", Weight: 1},
+				{ServiceName: "orders-canary", Weight: 0},
+			}
+			for i := 0; i < 10; i++ {
+				So(pickSplitService(zeroSlice, ""), ShouldEqual, "orders")
+			}
+		})
+		Convey("empty weight returns empty", func() {
+			So(pickSplitService([]config.SplitStruct{{ServiceName: "orders"}}, ""), ShouldEqual, "")
+		})
+	})
+}
+
+func TestFilterSubset(t *testing.T) {
+	Convey("filterSubset check", t, func() {
+		urlSlice := []config.ServiceUrlStruct{
+			{Url: "127.0.0.1:80", Weight: 1, Labels: map[string]string{"version": "v1", "zone": "a"}},
+			{Url: "127.0.0.2:80", Weight: 1, Labels: map[string]string{"version": "v2", "zone": "a"}},
+			{Url: "127.0.0.3:80", Weight: 1},
+		}
+		Convey("empty selector returns all", func() {
+			So(len(filterSubset(urlSlice, nil)), ShouldEqual, 3)
+		})
+		Convey("match all labels", func() {
+			subsetSlice := filterSubset(urlSlice, map[string]string{"version": "v2", "zone": "a"})
+			So(len(subsetSlice), ShouldEqual, 1)
+			So(subsetSlice[0].Url, ShouldEqual, "127.0.0.2:80")
+		})
+		Convey("no match", func() {
+			So(len(filterSubset(urlSlice, map[string]string{"version": "v3"})), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestFilterZone(t *testing.T) {
+	Convey("filterZone check", t, func() {
+		proxy := newTestProxy(nil, proxyConfig.LoadBalanceMode, config.Client{ZoneAware: config.ZoneAware{Open: true, MinHealthyPercent: 50}})
+		urlSlice := []config.ServiceUrlStruct{
+			{Url: "10.0.1.1:80", Weight: 1, Labels: map[string]string{ZoneLabel: "a"}},
+			{Url: "10.0.1.2:80", Weight: 1, Labels: map[string]string{ZoneLabel: "a"}},
+			{Url: "10.0.2.1:80", Weight: 1, Labels: map[string]string{ZoneLabel: "b"}},
+		}
+		Convey("prefer local zone", func() {
+			So(len(proxy.filterZone(urlSlice, "a")), ShouldEqual, 2)
+		})
+		Convey("no local endpoint uses all zones", func() {
+			So(len(proxy.filterZone(urlSlice, "c")), ShouldEqual, 3)
+		})
+		Convey("spill over when local healthy capacity below threshold", func() {
+			for i := 0; i < transmitErrorMaxCount; i++ {
+				proxy.recordEndpointFailure("10.0.1.1:80")
+			}
+			So(len(proxy.filterZone(urlSlice, "a")), ShouldEqual, 1)
+			for i := 0; i < transmitErrorMaxCount; i++ {
+				proxy.recordEndpointFailure("10.0.1.2:80")
+			}
+			zoneSlice := proxy.filterZone(urlSlice, "a")
+			So(len(zoneSlice), ShouldEqual, 1)
+			So(zoneSlice[0].Url, ShouldEqual, "10.0.2.1:80")
+		})
+	})
+}
+
+func TestApplySlowStart(t *testing.T) {
+	Convey("applySlowStart check", t, func() {
+		slowStartWindow := 100 * time.Second
+		now := time.Now()
+		urlSlice := []config.ServiceUrlStruct{
+			{Url: "127.0.0.1:80", Weight: 2},
+			{Url: "127.0.0.2:80", Weight: 2},
+			{Url: "127.0.0.3:80", Weight: 2},
+		}
+		addTimeMap := map[string]time.Time{
+			"127.0.0.1:80": {},
+			"127.0.0.2:80": now.Add(-50 * time.Second),
+			"127.0.0.3:80": now,
+		}
+		resultSlice := applySlowStart(urlSlice, addTimeMap, now, slowStartWindow)
+		So(resultSlice[0].Weight, ShouldEqual, 2*slowStartWeightScale)
+		So(resultSlice[1].Weight, ShouldEqual, slowStartWeightScale)
+		So(resultSlice[2].Weight, ShouldEqual, 1)
+		So(urlSlice[0].Weight, ShouldEqual, 2)
+		So(applySlowStart(urlSlice, addTimeMap, now, 0)[2].Weight, ShouldEqual, 2)
+	})
+}
+
+func TestDraining(t *testing.T) {
+	Convey("draining check", t, func() {
+		drainTimeout := 60 * time.Second
+		now := time.Now()
+		serviceMapStruct := etcd.ServiceMapStruct{
+			ServiceUrlSlice: []config.ServiceUrlStruct{
+				{Url: "127.0.0.1:80", Weight: 1},
+				{Url: "127.0.0.2:80", Weight: 1, Draining: true},
+				{Url: "127.0.0.3:80", Weight: 1, Draining: true},
+			},
+			DrainTimeMap: map[string]time.Time{
+				"127.0.0.2:80": now.Add(-10 * time.Second),
+				"127.0.0.3:80": now.Add(-120 * time.Second),
+			},
+		}
+		So(len(filterDraining(serviceMapStruct.ServiceUrlSlice)), ShouldEqual, 1)
+		So(isBoundHostAvailable("127.0.0.1:80", serviceMapStruct, now, drainTimeout), ShouldBeTrue)
+		So(isBoundHostAvailable("127.0.0.2:80", serviceMapStruct, now, drainTimeout), ShouldBeTrue)
+		So(isBoundHostAvailable("127.0.0.3:80", serviceMapStruct, now, drainTimeout), ShouldBeFalse)
+		So(isBoundHostAvailable("127.0.0.4:80", serviceMapStruct, now, drainTimeout), ShouldBeFalse)
+	})
+}
+
+func TestAffinityCookie(t *testing.T) {
+	Convey("affinity cookie check", t, func() {
+		a := newAffinity(config.SessionAffinity{Open: true, Secret: "secret", Ttl: 60})
+		now := time.Now()
+		cookie := a.newCookie("test", "127.0.0.1:80", now)
+		So(cookie.Name, ShouldEqual, defaultAffinityCookieName+"_test")
+		Convey("valid cookie", func() {
+			host, ok := a.parseValue(cookie.Value, "test", now)
+			So(ok, ShouldBeTrue)
+			So(host, ShouldEqual, "127.0.0.1:80")
+		})
+		Convey("other service", func() {
+			_, ok := a.parseValue(cookie.Value, "other", now)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("expired cookie", func() {
+			_, ok := a.parseValue(cookie.Value, "test", now.Add(61*time.Second))
+			So(ok, ShouldBeFalse)
+		})
+		Convey("tampered cookie", func() {
+			forged := a.signValue("test", "127.0.0.2:80", now.Add(time.Minute).Unix())
+			other := newAffinity(config.SessionAffinity{Open: true, Secret: "other", Ttl: 60})
+			_, ok := other.parseValue(forged, "test", now)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+// staticDiscover 固定节点的服务发现，测试时替代etcd
+type staticDiscover struct {
+	serviceMapStruct etcd.ServiceMapStruct
+	splitSlice       []config.SplitStruct
+}
+
+func (discover *staticDiscover) Get(serviceName string) (etcd.ServiceMapStruct, error) {
+	return discover.serviceMapStruct, nil
+}
+
+func (discover *staticDiscover) Exit() {}
+
+func (discover *staticDiscover) Delete(serviceName string) {}
+
+func (discover *staticDiscover) GetSplit(routeName string) []config.SplitStruct {
+	return discover.splitSlice
+}
+
+func (discover *staticDiscover) PutSplit(routeName string, splitSlice []config.SplitStruct) error {
+	return nil
+}
+
+func (discover *staticDiscover) SetDraining(serviceName string, url string, draining bool) error {
+	return nil
+}
+
+func TestResolveService(t *testing.T) {
+	Convey("split resolved once per request", t, func() {
+		discover := &staticDiscover{
+			serviceMapStruct: etcd.ServiceMapStruct{ServiceUrlSlice: []config.ServiceUrlStruct{{Url: "10.0.0.1:80", Weight: 1}}},
+			splitSlice:       []config.SplitStruct{{ServiceName: "test", Weight: 50}, {ServiceName: "test-canary", Weight: 50}},
+		}
+		proxy := newTestProxy(discover, proxyConfig.LoadBalanceMode, config.Client{})
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest("GET", "/test/get", nil)
+			req = req.WithContext(context.WithValue(req.Context(), splitChoiceKey{}, &splitChoice{}))
+			serviceName := proxy.ResolveService(req)
+			for j := 0; j < 5; j++ {
+				So(proxy.ResolveService(req), ShouldEqual, serviceName)
+			}
+			_, transmitService := proxy.getRawUrlAndServiceName(req)
+			So(transmitService, ShouldEqual, serviceName)
+		}
+	})
+}
+
+func TestAffinityCookieReselect(t *testing.T) {
+	Convey("pinned endpoint re-checked against tier and zone", t, func() {
+		discover := &staticDiscover{serviceMapStruct: etcd.ServiceMapStruct{ServiceUrlSlice: []config.ServiceUrlStruct{
+			{Url: "10.0.0.1:80", Weight: 1, Labels: map[string]string{ZoneLabel: "a"}},
+			{Url: "10.0.1.1:80", Weight: 1, Priority: 1, Labels: map[string]string{ZoneLabel: "a"}},
+			{Url: "10.0.2.1:80", Weight: 1, Labels: map[string]string{ZoneLabel: "b"}},
+		}}}
+		proxy := newTestProxy(discover, proxyConfig.LoadBalanceMode, config.Client{
+			Zone:            "a",
+			ZoneAware:       config.ZoneAware{Open: true, MinHealthyPercent: 50},
+			SessionAffinity: config.SessionAffinity{Open: true, Secret: "secret", Ttl: 60},
+		})
+		pinnedRequest := func(host string) *http.Request {
+			req := httptest.NewRequest("GET", "/test/get", nil)
+			req.AddCookie(proxy.affinity.newCookie("test", host, time.Now()))
+			return req
+		}
+		So(proxy.getTransmitHostByCookie(pinnedRequest("10.0.0.1:80"), "test", nil), ShouldEqual, "10.0.0.1:80")
+		//主节点及本区域节点健康时不再使用绑定的备用或跨区域节点
+		So(proxy.getTransmitHostByCookie(pinnedRequest("10.0.1.1:80"), "test", nil), ShouldBeEmpty)
+		So(proxy.getTransmitHostByCookie(pinnedRequest("10.0.2.1:80"), "test", nil), ShouldBeEmpty)
+		for i := 0; i < transmitErrorMaxCount; i++ {
+			proxy.recordEndpointFailure("10.0.0.1:80")
+			proxy.recordEndpointFailure("10.0.2.1:80")
+		}
+		So(proxy.getTransmitHostByCookie(pinnedRequest("10.0.1.1:80"), "test", nil), ShouldEqual, "10.0.1.1:80")
+	})
+}
+
+func TestSelectPriorityTier(t *testing.T) {
+	Convey("selectPriorityTier check", t, func() {
+		proxy := newTestProxy(nil, proxyConfig.LoadBalanceMode, config.Client{})
+		urlSlice := []config.ServiceUrlStruct{
+			{Url: "10.0.0.1:80", Weight: 1},
+			{Url: "10.0.0.2:80", Weight: 1},
+			{Url: "10.0.1.1:80", Weight: 1, Priority: 1},
+		}
+		Convey("primary tier preferred", func() {
+			So(len(proxy.selectPriorityTier(urlSlice)), ShouldEqual, 2)
+		})
+		Convey("backup tier used when every primary ejected", func() {
+			for i := 0; i < transmitErrorMaxCount; i++ {
+				proxy.recordEndpointFailure("10.0.0.1:80")
+				proxy.recordEndpointFailure("10.0.0.2:80")
+			}
+			tierSlice := proxy.selectPriorityTier(urlSlice)
+			So(len(tierSlice), ShouldEqual, 1)
+			So(tierSlice[0].Url, ShouldEqual, "10.0.1.1:80")
+		})
+	})
+}
+
+func TestRegisterBalancer(t *testing.T) {
+	Convey("register custom balancer", t, func() {
+		RegisterBalancer("label_first", BalancerFunc(func(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
+			for _, urlStruct := range urlSlice {
+				if urlStruct.Labels["tenant"] == req.Header.Get("X-Tenant") {
+					return urlStruct.Url
+				}
+			}
+			return urlSlice[0].Url
+		}))
+		balancer, ok := balancerMap["label_first"]
+		So(ok, ShouldBeTrue)
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Tenant", "b")
+		urlSlice := []config.ServiceUrlStruct{
+			{Url: "127.0.0.1:80", Labels: map[string]string{"tenant": "a"}},
+			{Url: "127.0.0.2:80", Labels: map[string]string{"tenant": "b"}},
+		}
+		So(balancer.Pick(req, "test", urlSlice), ShouldEqual, "127.0.0.2:80")
+	})
+}
+
+func TestProxyIsolation(t *testing.T) {
+	Convey("proxies do not share state", t, func() {
+		first := newTestProxy(nil, proxyConfig.LoadBalanceMode, config.Client{})
+		second := newTestProxy(nil, proxyConfig.LoadBalanceMode, config.Client{})
+		for i := 0; i < transmitErrorMaxCount; i++ {
+			first.recordEndpointFailure("10.0.0.1:80")
+		}
+		So(first.isEndpointHealthy("10.0.0.1:80"), ShouldBeFalse)
+		So(second.isEndpointHealthy("10.0.0.1:80"), ShouldBeTrue)
+		first.recordStatistics("test", http.StatusBadGateway, time.Millisecond)
+		So(first.GetStatistics("test").ErrorCount, ShouldEqual, 1)
+		So(second.GetStatistics("test").RequestCount, ShouldEqual, 0)
+	})
+	Convey("middleware rejection uses proxy error page", t, func() {
+		pageConfig := config.Client{
+			IpTable: []string{"127.0.0.1"},
+			ReverseHost: []config.ReverseHost{
+				{ServiceName: "test", ErrorPage: config.ErrorPage{ContentType: "text/plain", Template: "{{.Code}}"}},
+			},
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/test/get", nil)
+		req.RemoteAddr = "127.0.0.1:80"
+		newTestProxy(nil, proxyConfig.LoadBalanceMode, pageConfig).ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, http.StatusForbidden)
+		So(w.Body.String(), ShouldEqual, "403")
+	})
+}
@@ -2,6 +2,7 @@ package transmit
 
 import (
 	"math/rand"
+	"net/http"
 	"time"
 
 	"simple_proxygateway/config"
@@ -11,15 +12,19 @@ type weightTransmit struct {
 }
 
 func init() {
-	register(config.LoadBalanceModeWeight, &weightTransmit{})
+	RegisterBalancer(config.LoadBalanceModeWeight, &weightTransmit{})
 }
 
-func (weightTransmit weightTransmit) getUrlString(urlSlice []config.ServiceUrlStruct, ip string) string {
+func (weightTransmit weightTransmit) Pick(req *http.Request, serviceName string, urlSlice []config.ServiceUrlStruct) string {
 	rand.Seed(time.Now().UnixNano())
 	maxLen := 0
 	for _, urlStruct := range urlSlice {
 		maxLen += urlStruct.Weight
 	}
+	//子集、区域、优先级筛选或慢启动后可能只剩权重为0的节点，此时均匀选择
+	if maxLen <= 0 {
+		return urlSlice[rand.Intn(len(urlSlice))].Url
+	}
 	randIndex := rand.Intn(maxLen)
 	index := 0
 	for _, urlStruct := range urlSlice {
@@ -0,0 +1,30 @@
+package transmit
+
+import (
+	"simple_proxygateway/config"
+)
+
+// ZoneLabel 节点所在区域的标签名称
+const ZoneLabel = "zone"
+
+// filterZone 优先选择同区域的健康节点，同区域健康节点占比低于阈值时溢出至全部区域
+func (p *Proxy) filterZone(urlSlice []config.ServiceUrlStruct, zone string) []config.ServiceUrlStruct {
+	if !p.zoneAware.Open || zone == "" {
+		return p.filterHealthy(urlSlice)
+	}
+	localSlice := make([]config.ServiceUrlStruct, 0, len(urlSlice))
+	healthyLocalSlice := make([]config.ServiceUrlStruct, 0, len(urlSlice))
+	for _, urlStruct := range urlSlice {
+		if urlStruct.Labels[ZoneLabel] != zone {
+			continue
+		}
+		localSlice = append(localSlice, urlStruct)
+		if p.isEndpointHealthy(urlStruct.Url) {
+			healthyLocalSlice = append(healthyLocalSlice, urlStruct)
+		}
+	}
+	if len(healthyLocalSlice) == 0 || len(healthyLocalSlice)*100 < p.zoneAware.MinHealthyPercent*len(localSlice) {
+		return p.filterHealthy(urlSlice)
+	}
+	return healthyLocalSlice
+}